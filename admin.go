@@ -0,0 +1,517 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+	"k8s.io/utils/clock"
+)
+
+// QueryOption is an option function for the functions inspecting a
+// coordination directory and querying its owner, such as InspectDir and
+// QueryStatus.
+type QueryOption func(o *queryOptions)
+
+type queryOptions struct {
+	group string
+}
+
+// InGroup makes an inspection or query target the named group of the
+// coordination directory, see WithGroup, rather than the default group.
+func InGroup(name string) QueryOption {
+	return func(o *queryOptions) {
+		o.group = name
+	}
+}
+
+// queryCoordinator returns a coordinator for inspecting the group of the
+// coordination directory targeted by opts.
+func queryCoordinator(coordinationDir string, opts []QueryOption) (*coordinator, error) {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validateGroup(o.group); err != nil {
+		return nil, err
+	}
+	coord := newCoordinator(clock.RealClock{}, slog.New(slog.DiscardHandler), coordinationDir, "")
+	coord.group = o.group
+	return coord, nil
+}
+
+// FdInfo describes a file descriptor held by an owner, as reported by
+// QueryFds.
+type FdInfo struct {
+	ID   string
+	Kind string
+	// Network and Addr are set for listeners and conns.
+	Network string
+	Addr    string
+}
+
+// DirStatus describes the state of a coordination directory, as reported by
+// InspectDir.
+type DirStatus struct {
+	// OwnerID is the id of the owner, or empty if there is none.
+	OwnerID string
+	// OwnerListening is true if the owner accepts connections on its upgrade
+	// socket. If false, the owner most likely crashed.
+	OwnerListening bool
+	// Locked is true if a process holds the lock on the directory, which is
+	// the case while it's taking over from the owner.
+	Locked bool
+	// LockHolderPID is the pid of the process holding the lock, if it could be
+	// determined. This is only supported on linux.
+	LockHolderPID int
+	// StaleSockets are the paths of upgrade sockets nobody listens on anymore,
+	// which CleanupDir removes.
+	StaleSockets []string
+}
+
+// OwnerStatus describes the owner of a coordination directory, as reported by
+// QueryStatus.
+type OwnerStatus struct {
+	ProcessInfo
+	// State is the owner's state, such as "owner", "transferring-ownership" or
+	// "draining".
+	State string
+	// ProtocolVersion is the handoff protocol version the owner speaks.
+	ProtocolVersion int
+	// Fds is the number of file descriptors held by the owner.
+	Fds int
+	// UpgradeInProgress is true while the owner is handing its file
+	// descriptors to a new process.
+	UpgradeInProgress bool
+}
+
+// QueryStatus asks the owner of the given coordination directory for its
+// state. Like the other queries, this doesn't start an upgrade nor block one,
+// and it's answered while an upgrade is in progress too.
+//
+// Queries are part of version 3 of the handoff protocol. Owners speaking an
+// older version treat a query as an upgrade attempt which fails, and remain
+// the owner.
+func QueryStatus(ctx context.Context, coordinationDir string, opts ...QueryOption) (*OwnerStatus, error) {
+	resp, err := queryOwner(ctx, coordinationDir, proto.QueryStatus, opts)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("owner didn't report its status")
+	}
+	return &OwnerStatus{
+		ProcessInfo:       processInfoFromProto(resp.Status.Process),
+		State:             resp.Status.State,
+		ProtocolVersion:   int(resp.Version),
+		Fds:               resp.Status.Fds,
+		UpgradeInProgress: resp.Status.UpgradeInProgress,
+	}, nil
+}
+
+// QueryFds asks the owner of the given coordination directory for the file
+// descriptors it holds. Unlike connecting to its upgrade socket directly, this
+// doesn't start an upgrade.
+func QueryFds(ctx context.Context, coordinationDir string, opts ...QueryOption) ([]FdInfo, error) {
+	resp, err := queryOwner(ctx, coordinationDir, proto.QueryFds, opts)
+	if err != nil {
+		return nil, err
+	}
+	fds := make([]FdInfo, 0, len(resp.Fds))
+	for _, item := range resp.Fds {
+		fds = append(fds, FdInfo(item))
+	}
+	return fds, nil
+}
+
+// WatchEvents streams the events emitted by the owner of the given
+// coordination directory to fn, until the owner stops, which includes it
+// stepping down for a new owner, or ctx is cancelled. It returns nil once the
+// owner stopped, so callers who want to follow the upgrade chain should call
+// it again.
+// Events are dropped if fn doesn't keep up with them.
+func WatchEvents(ctx context.Context, coordinationDir string, fn func(Event), opts ...QueryOption) error {
+	conn, err := connectQuery(ctx, coordinationDir, proto.QueryEvents, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	for {
+		var ev proto.Event
+		if err := proto.ReadJSONBlob(conn, &ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading event: %w", err)
+		}
+		fn(eventFromProto(ev))
+	}
+}
+
+// InspectDir reports the state of the given coordination directory. It only
+// reads the directory and doesn't require the owner to be reachable.
+func InspectDir(ctx context.Context, coordinationDir string, opts ...QueryOption) (*DirStatus, error) {
+	coord, err := queryCoordinator(coordinationDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	status := &DirStatus{}
+	ownerID, err := coord.GetOwnerID()
+	switch {
+	case err == nil:
+		status.OwnerID = ownerID
+	case errors.Is(err, errNoOwner) || errors.Is(err, os.ErrNotExist):
+	default:
+		return nil, err
+	}
+
+	locked, err := coord.IsLocked()
+	if err != nil {
+		return nil, err
+	}
+	status.Locked = locked
+	if locked {
+		status.LockHolderPID = lockHolder(coord.idFile())
+	}
+
+	socks, err := coord.Sockets()
+	if err != nil {
+		return nil, err
+	}
+	for id, path := range socks {
+		listening, err := probeSocket(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if !listening {
+			status.StaleSockets = append(status.StaleSockets, path)
+		} else if id == status.OwnerID {
+			status.OwnerListening = true
+		}
+	}
+	slices.Sort(status.StaleSockets)
+	return status, nil
+}
+
+// CleanupDir removes the upgrade sockets left behind in the given coordination
+// directory by processes which exited without closing them, such as processes
+// which crashed. It returns the paths of the removed sockets.
+func CleanupDir(ctx context.Context, coordinationDir string, opts ...QueryOption) ([]string, error) {
+	status, err := InspectDir(ctx, coordinationDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, path := range status.StaleSockets {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// probeSocket reports whether a process accepts connections on the given
+// upgrade socket. Only a refused connection counts as not listening.
+func probeSocket(ctx context.Context, path string) (bool, error) {
+	conn, err := dialQuery(ctx, path)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return false, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// exited and removed its socket in the meantime
+			return true, nil
+		}
+		return false, err
+	}
+	return true, conn.Close()
+}
+
+// dialQuery connects to an upgrade socket from a socket bound to an address
+// starting with proto.QueryAddrPrefix, which tells the process listening on it
+// to expect a query instead of an upgrade.
+func dialQuery(ctx context.Context, sockPath string) (*net.UnixConn, error) {
+	laddr := &net.UnixAddr{
+		Net:  "unix",
+		Name: filepath.Join(os.TempDir(), fmt.Sprintf("%s%d-%d.sock", proto.QueryAddrPrefix, os.Getpid(), rand.Uint64())),
+	}
+	conn, err := (&net.Dialer{LocalAddr: laddr}).DialContext(ctx, "unix", sockPath)
+	// the peer already knows the address once connected
+	_ = os.Remove(laddr.Name)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UnixConn), nil
+}
+
+// connectQuery connects to the owner of the given coordination directory and
+// sends it a query of the given type.
+func connectQuery(ctx context.Context, coordinationDir string, queryType string, opts []QueryOption) (*net.UnixConn, error) {
+	coord, err := queryCoordinator(coordinationDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := coord.GetOwnerID()
+	if err != nil {
+		return nil, fmt.Errorf("can't find owner: %w", err)
+	}
+	conn, err := dialQuery(ctx, coord.sockPath(oid))
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to owner %v: %w", oid, err)
+	}
+	if err := proto.WriteJSONBlob(conn, proto.Query{Version: proto.Version, Type: queryType}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error sending query: %w", err)
+	}
+	return conn, nil
+}
+
+func queryOwner(ctx context.Context, coordinationDir string, queryType string, opts []QueryOption) (*proto.QueryResponse, error) {
+	conn, err := connectQuery(ctx, coordinationDir, queryType, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	var resp proto.QueryResponse
+	if err := proto.ReadJSONBlob(conn, &resp); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("error reading query response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// isQueryConn reports whether conn was made by dialQuery.
+func isQueryConn(conn *net.UnixConn) bool {
+	addr, ok := conn.RemoteAddr().(*net.UnixAddr)
+	if !ok || addr == nil {
+		return false
+	}
+	return strings.HasPrefix(filepath.Base(addr.Name), proto.QueryAddrPrefix)
+}
+
+// handleQuery answers a query made by dialQuery. Queries only read the
+// upgrader's state, so they're answered while an upgrade is in progress too.
+func (u *Upgrader) handleQuery(conn *net.UnixConn) {
+	defer conn.Close()
+	if !u.trackQuery(conn) {
+		return
+	}
+	defer u.untrackQuery(conn)
+
+	// a client has as long as an upgrade would take to send its query
+	if err := conn.SetReadDeadline(time.Now().Add(u.upgradeTimeout)); err != nil {
+		u.l.Warn("error setting query deadline", "err", err)
+		return
+	}
+	var query proto.Query
+	if err := proto.ReadJSONBlob(conn, &query); err != nil {
+		// probeSocket connects without sending a query
+		if !errors.Is(err, io.EOF) {
+			u.l.Warn("error reading query", "err", err)
+		}
+		return
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		u.l.Warn("error clearing query deadline", "err", err)
+		return
+	}
+	u.l.Debug("handling query", "type", query.Type)
+
+	resp := proto.QueryResponse{Version: proto.Version}
+	switch query.Type {
+	case proto.QueryStatus:
+		resp.Status = u.queryStatus()
+	case proto.QueryFds:
+		fds, err := u.queryFds()
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Fds = fds
+	case proto.QueryEvents:
+		u.streamEvents(conn)
+		return
+	default:
+		resp.Error = fmt.Sprintf("unknown query type %q", query.Type)
+	}
+	if err := proto.WriteJSONBlob(conn, resp); err != nil {
+		u.l.Warn("error answering query", "type", query.Type, "err", err)
+	}
+}
+
+// trackQuery registers a query connection to be closed by Stop, and reports
+// whether the upgrader is still running.
+func (u *Upgrader) trackQuery(conn *net.UnixConn) bool {
+	u.queryLock.Lock()
+	defer u.queryLock.Unlock()
+	if u.queryStopped {
+		return false
+	}
+	if u.queryConns == nil {
+		u.queryConns = make(map[*net.UnixConn]struct{})
+	}
+	u.queryConns[conn] = struct{}{}
+	return true
+}
+
+func (u *Upgrader) untrackQuery(conn *net.UnixConn) {
+	u.queryLock.Lock()
+	defer u.queryLock.Unlock()
+	delete(u.queryConns, conn)
+}
+
+// closeQueries closes the query connections being handled, and makes further
+// ones be closed right away.
+func (u *Upgrader) closeQueries() {
+	u.queryLock.Lock()
+	defer u.queryLock.Unlock()
+	u.queryStopped = true
+	for conn := range u.queryConns {
+		_ = conn.Close()
+	}
+	u.queryConns = nil
+}
+
+// ownsFds returns the upgrader's state, and whether it's the owner of its
+// Fds in that state.
+func (u *Upgrader) ownsFds() (upgraderState, bool) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.state, u.state == upgraderStateOwner || u.state == upgraderStateTransferringOwnership
+}
+
+func (u *Upgrader) queryStatus() *proto.Status {
+	state, owner := u.ownsFds()
+	status := &proto.Status{
+		Process:           u.processInfo().toProto(),
+		State:             string(state),
+		UpgradeInProgress: state == upgraderStateTransferringOwnership,
+	}
+	if owner {
+		status.Fds = len(u.Fds.copy())
+	}
+	return status
+}
+
+func (u *Upgrader) queryFds() ([]proto.FdInfo, error) {
+	state, owner := u.ownsFds()
+	if !owner {
+		return nil, fmt.Errorf("process %v is not the owner, it is %v", u.coord.id, state)
+	}
+
+	fds := u.Fds.copy()
+	res := make([]proto.FdInfo, 0, len(fds))
+	for _, item := range fds {
+		res = append(res, proto.FdInfo{
+			ID:      item.ID,
+			Kind:    string(item.Kind),
+			Network: item.Network,
+			Addr:    item.Addr,
+		})
+	}
+	slices.SortFunc(res, func(a, b proto.FdInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res, nil
+}
+
+// streamEvents writes the upgrader's events to conn until the client
+// disconnects or the upgrader stops.
+func (u *Upgrader) streamEvents(conn *net.UnixConn) {
+	events, unsubscribe := u.subscribeEvents()
+	defer unsubscribe()
+
+	// the client doesn't send anything else, so a read returns once it's gone
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+
+	write := func(ev Event) bool {
+		if err := proto.WriteJSONBlob(conn, eventToProto(ev)); err != nil {
+			u.l.Debug("error streaming event", "err", err)
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case ev := <-events:
+			if !write(ev) {
+				return
+			}
+		case <-u.upgradeCompleteC:
+			// flush what was emitted up until stepping down
+			for {
+				select {
+				case ev := <-events:
+					if !write(ev) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-clientGone:
+			return
+		}
+	}
+}
+
+func eventToProto(ev Event) proto.Event {
+	res := proto.Event{
+		Type: string(ev.Type),
+		Time: ev.Time,
+		Peer: ev.Peer.toProto(),
+	}
+	if ev.Err != nil {
+		res.Error = ev.Err.Error()
+	}
+	if ev.Listener != nil {
+		change := proto.ListenerChange(*ev.Listener)
+		res.Listener = &change
+	}
+	return res
+}
+
+func eventFromProto(ev proto.Event) Event {
+	res := Event{
+		Type: EventType(ev.Type),
+		Time: ev.Time,
+		Peer: processInfoFromProto(ev.Peer),
+	}
+	if ev.Error != "" {
+		res.Err = errors.New(ev.Error)
+	}
+	if ev.Listener != nil {
+		change := ListenerChange(*ev.Listener)
+		res.Listener = &change
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package tableroll
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockHolder returns the pid of the process holding a flock on the given
+// file according to /proc/locks, or 0 if it can't be determined.
+func lockHolder(path string) int {
+	pid, _, _ := findFlock(path)
+	return pid
+}
+
+// flocked reports whether a process holds a flock on the given file according
+// to /proc/locks. Unlike trying to take the lock, this doesn't get in the way
+// of a process which is about to take it.
+func flocked(path string) (bool, error) {
+	_, found, err := findFlock(path)
+	return found, err
+}
+
+// findFlock looks up a flock on the given file in /proc/locks. The pid is 0 if
+// the lock's holder can't be determined.
+func findFlock(path string) (int, bool, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, false, err
+	}
+	// /proc/locks identifies files as major:minor:inode, with the device
+	// numbers in hex
+	dev := fmt.Sprintf("%02x:%02x:%d", unix.Major(st.Dev), unix.Minor(st.Dev), st.Ino)
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return 0, false, err
+	}
+	defer locks.Close()
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		// e.g. "1: FLOCK  ADVISORY  WRITE 1234 00:2d:5678 0 EOF"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != dev {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil {
+			pid = 0
+		}
+		return pid, true, nil
+	}
+	return 0, false, scanner.Err()
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package tableroll
+
+import (
+	"github.com/euank/filelock"
+	"github.com/pkg/errors"
+)
+
+// lockHolder can't determine lock holders on this platform.
+func lockHolder(string) int {
+	return 0
+}
+
+// flocked reports whether a process holds a flock on the given file. There's
+// no way to check without trying to take the lock on this platform, so a
+// process taking the lock at the same time may briefly fail to.
+func flocked(path string) (bool, error) {
+	flock, err := filelock.NewLock(path, filelock.RegFile)
+	if err != nil {
+		return false, err
+	}
+	defer flock.Close()
+	err = flock.TryExclusiveLock()
+	if err == filelock.ErrLocked {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "error trying to lock coordination directory")
+	}
+	return false, flock.Unlock()
+}
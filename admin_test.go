@@ -0,0 +1,244 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestQueryFds(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg.Stop()
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	// not the owner before Ready
+	_, err = QueryFds(ctx, coordDir)
+	require.Error(t, err)
+
+	require.NoError(t, upg.Ready())
+	fds, err := QueryFds(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, []FdInfo{{ID: "ln", Kind: "listener", Network: "tcp", Addr: "127.0.0.1:0"}}, fds)
+
+	// the query didn't start an upgrade
+	select {
+	case <-upg.UpgradeComplete():
+		t.Fatal("query completed an upgrade")
+	default:
+	}
+	_, err = upg.Fds.Listen(ctx, "ln2", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+}
+
+func TestWatchEvents(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+
+	events := make(chan Event, 10)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- WatchEvents(ctx, coordDir, func(ev Event) { events <- ev })
+	}()
+	// wait for the watcher to be subscribed
+	require.Eventually(t, func() bool {
+		upg1.eventLock.Lock()
+		defer upg1.eventLock.Unlock()
+		return len(upg1.eventSubscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	require.NoError(t, upg2.Ready())
+
+	// the stream ends once the watched owner stepped down
+	require.NoError(t, <-watchErr)
+	close(events)
+	var types []EventType
+	for ev := range events {
+		require.Equal(t, "2", ev.Peer.ID)
+		types = append(types, ev.Type)
+	}
+	require.Equal(t, []EventType{EventUpgradeRequested, EventSteppedDown}, types)
+}
+
+func TestInspectAndCleanupDir(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	status, err := InspectDir(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, &DirStatus{}, status)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	// a socket left behind by a crashed process
+	stalePath := filepath.Join(coordDir, "crashed.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: stalePath})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	status, err = InspectDir(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, &DirStatus{
+		OwnerID:        "1",
+		OwnerListening: true,
+		StaleSockets:   []string{stalePath},
+	}, status)
+
+	removed, err := CleanupDir(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{stalePath}, removed)
+	_, err = os.Stat(stalePath)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(upgradeSockPath(coordDir, "1"))
+	require.NoError(t, err)
+
+	// the inspection didn't start an upgrade
+	select {
+	case <-upg.UpgradeComplete():
+		t.Fatal("inspection completed an upgrade")
+	default:
+	}
+}
+
+func TestInspectDirLocked(t *testing.T) {
+	coordDir := tmpDir(t)
+	coord := newCoordinator(clock.RealClock{}, l, coordDir, "1")
+	require.NoError(t, coord.Lock(context.Background()))
+	defer func() { _ = coord.Unlock() }()
+
+	status, err := InspectDir(context.Background(), coordDir)
+	require.NoError(t, err)
+	require.True(t, status.Locked)
+	if status.LockHolderPID != 0 {
+		require.Equal(t, os.Getpid(), status.LockHolderPID)
+	}
+
+	require.NoError(t, coord.Unlock())
+	status, err = InspectDir(context.Background(), coordDir)
+	require.NoError(t, err)
+	require.False(t, status.Locked)
+	require.Zero(t, status.LockHolderPID)
+}
+
+func TestQueryStatus(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithAppVersion("v1"), WithLabels(map[string]string{"shard": "a"}))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, upg1.Ready())
+
+	status, err := QueryStatus(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, &OwnerStatus{
+		ProcessInfo:     ProcessInfo{ID: "1", AppVersion: "v1", Labels: map[string]string{"shard": "a"}},
+		State:           "owner",
+		ProtocolVersion: proto.Version,
+		Fds:             1,
+	}, status)
+
+	// queries are answered while an upgrade is in progress
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	status, err = QueryStatus(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, "transferring-ownership", status.State)
+	require.True(t, status.UpgradeInProgress)
+	fds, err := QueryFds(ctx, coordDir)
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+
+	// and don't get in its way
+	ln2, err := upg2.Fds.Listener("ln")
+	require.NoError(t, err)
+	defer func() { _ = ln2.Close() }()
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	status, err = QueryStatus(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, "2", status.ID)
+	require.Equal(t, 1, status.Fds)
+}
+
+func TestQueryDeadline(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithUpgradeTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	// a client which doesn't send its query in time is disconnected
+	conn, err := dialQuery(ctx, upg.coord.sockPath("1"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	awaitQueryClosed(t, conn)
+}
+
+func TestStopClosesQueries(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	// a pending query and an event stream
+	conn, err := dialQuery(ctx, upg.coord.sockPath("1"))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	events, err := connectQuery(ctx, coordDir, proto.QueryEvents, nil)
+	require.NoError(t, err)
+	defer func() { _ = events.Close() }()
+	require.Eventually(t, func() bool {
+		upg.queryLock.Lock()
+		defer upg.queryLock.Unlock()
+		return len(upg.queryConns) == 2
+	}, 5*time.Second, time.Millisecond)
+
+	upg.Stop()
+	awaitQueryClosed(t, conn)
+	awaitQueryClosed(t, events)
+}
+
+// awaitQueryClosed waits for the process to close a query connection.
+func awaitQueryClosed(t *testing.T, conn net.Conn) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, io.EOF), "unexpected error: %v", err)
+}
@@ -0,0 +1,532 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+)
+
+// ErrBacklogHandOffUnsupported is returned by HandOffBacklog if there is no
+// new owner to hand connections to, or it speaks a protocol version which
+// can't receive them.
+var ErrBacklogHandOffUnsupported = errors.New("no new owner able to receive handed off connections")
+
+// WithBacklogHandler configures a function which receives connections the
+// previous owner handed off with HandOffBacklog for a listener this process
+// didn't retrieve, such as one which was removed in this release.
+// Without a handler, such connections are closed.
+func WithBacklogHandler(handler func(id string, conn net.Conn)) Option {
+	return func(u *Upgrader) {
+		u.backlogHandler = handler
+	}
+}
+
+// backlogSender hands connections to the next owner over the connection the
+// upgrade was performed on.
+type backlogSender struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+	// requested is closed once the next owner listed the listeners it didn't
+	// keep in ids, or failed to. ids is nil in the latter case.
+	requested chan struct{}
+	ids       map[string]bool
+	// kept are the listeners connections keep being handed off from until the
+	// sender is closed.
+	kept   []net.Listener
+	closed bool
+	l      *slog.Logger
+}
+
+func newBacklogSender(l *slog.Logger, conn *net.UnixConn) (*backlogSender, error) {
+	if err := setNonblock(conn); err != nil {
+		return nil, err
+	}
+	b := &backlogSender{
+		conn:      conn,
+		requested: make(chan struct{}),
+		l:         l,
+	}
+	go b.readRequest()
+	return b, nil
+}
+
+func (b *backlogSender) readRequest() {
+	defer close(b.requested)
+	var req proto.BacklogRequest
+	if err := proto.ReadJSONBlob(b.conn, &req); err != nil {
+		b.l.Warn("next owner didn't say which backlogs it wants", "err", err)
+		return
+	}
+	b.ids = make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		b.ids[id] = true
+	}
+}
+
+func (b *backlogSender) send(id string, connFd int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := proto.WriteJSONBlob(b.conn, proto.BacklogConn{ID: id}); err != nil {
+		return err
+	}
+	_, _, err := b.conn.WriteMsgUnix([]byte(id), unix.UnixRights(connFd), nil)
+	return err
+}
+
+// wants reports whether the next owner wants the backlog of the listener with
+// the given id, and whether it said which backlogs it wants at all yet.
+func (b *backlogSender) wants(id string) (wanted bool, requested bool) {
+	select {
+	case <-b.requested:
+	default:
+		return false, false
+	}
+	if b.ids == nil {
+		return false, false
+	}
+	return b.ids[id], true
+}
+
+// keep registers ln to be closed along with b, and reports whether b is
+// still open.
+func (b *backlogSender) keep(ln net.Listener) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.kept = append(b.kept, ln)
+	return true
+}
+
+func (b *backlogSender) Close() error {
+	// closing the connection first interrupts a send holding the lock
+	err := b.conn.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, ln := range b.kept {
+		_ = ln.Close()
+	}
+	b.kept = nil
+	return err
+}
+
+// HandOffBacklog closes ln, the listener with the given id, without
+// resetting the connections waiting in its accept queue. It is meant to be
+// called once UpgradeComplete is closed, instead of closing ln.
+//
+// If the new owner kept the listener's socket, the queued connections are
+// left for it to accept. Otherwise, such as when the new owner no longer uses
+// the listener, its address changed, or it overlaps it using
+// Fds.ListenOverlap, HandOffBacklog stops accepting on ln and hands the queued
+// connections to the new owner. The new owner delivers them to the listener
+// replacing the old one, or else to its WithBacklogHandler.
+//
+// If ln's socket has SO_REUSEPORT set, new connections to its group are
+// first routed to the socket the new owner bound with ListenOverlap. Where
+// the kernel doesn't support that, or an owner before this one still holds a
+// socket in the group, HandOffBacklog leaves ln open and keeps
+// handing off the connections routed to it until Stop is called, after which
+// it is closed. Connections routed to it as the process exits may then still
+// be reset, unless the net.ipv4.tcp_migrate_req sysctl is enabled.
+//
+// If the new owner can't receive connections, ln is still closed and
+// ErrBacklogHandOffUnsupported is returned.
+func (u *Upgrader) HandOffBacklog(id string, ln net.Listener) error {
+	u.backlogLock.Lock()
+	sender := u.backlogSender
+	u.backlogLock.Unlock()
+	if sender == nil {
+		_ = ln.Close()
+		return ErrBacklogHandOffUnsupported
+	}
+	timeout := u.clock.NewTimer(u.upgradeTimeout)
+	defer timeout.Stop()
+	select {
+	case <-sender.requested:
+	case <-timeout.C():
+	}
+	wanted, requested := sender.wants(id)
+	if !requested {
+		_ = ln.Close()
+		return ErrBacklogHandOffUnsupported
+	}
+	if !wanted {
+		u.l.Info("new owner kept listener, leaving its backlog to it", "id", id)
+		return ln.Close()
+	}
+
+	fdLn, ok := unwrapListener(ln)
+	if !ok {
+		_ = ln.Close()
+		return fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
+	}
+	raw, err := fdLn.SyscallConn()
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+
+	// A listener which receives handed off connections may be accepting from
+	// ln in the background, and would close what it accepted once ln is closed.
+	// Hand off what it accepts from now on as well.
+	bl := findBacklogListener(ln)
+	if bl != nil {
+		bl.divertTo(func(conn net.Conn) {
+			if err := sendConn(sender, id, conn); err != nil {
+				u.l.Warn("can't hand off connection", "id", id, "err", err)
+			}
+			_ = conn.Close()
+		})
+	}
+
+	handedOff := 0
+	var errs []error
+	var inGroup bool
+	var steerErr error
+	// The listener's fd is non-blocking, so accepting fails with EAGAIN once the
+	// queue is empty.
+	err = raw.Control(func(fd uintptr) {
+		// If the new owner overlaps the listener, its socket is in the same
+		// SO_REUSEPORT group, and ln remains in it until this process exits
+		// since the store holds a copy of it. New connections must go to the
+		// new owner's socket before draining ln, or they'd be reset then.
+		inGroup, steerErr = steerReusePortGroup(int(fd))
+		for {
+			connFd, _, err := unix.Accept(int(fd))
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			if err != nil {
+				if err != unix.EAGAIN {
+					errs = append(errs, fmt.Errorf("can't accept: %w", err))
+				}
+				return
+			}
+			if err := sender.send(id, connFd); err != nil {
+				errs = append(errs, fmt.Errorf("can't hand off connection: %w", err))
+			} else {
+				handedOff++
+			}
+			_ = unix.Close(connFd)
+		}
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	u.l.Info("handed off listener backlog to new owner", "id", id, "conns", handedOff)
+	if inGroup && steerErr != nil && len(errs) == 0 && sender.keep(ln) {
+		u.l.Warn("can't route new connections to the new owner's socket, handing them off until stopped", "id", id, "err", steerErr)
+		go u.keepHandingOff(id, ln, fdLn, sender)
+		return nil
+	}
+	errs = append(errs, ln.Close())
+	if bl != nil {
+		bl.waitAccepting()
+	}
+	return errors.Join(errs...)
+}
+
+// keepHandingOff hands off the connections accepted on fdLn, which ln wraps,
+// until the sender closes ln.
+func (u *Upgrader) keepHandingOff(id string, ln net.Listener, fdLn Listener, sender *backlogSender) {
+	handedOff := 0
+	for {
+		conn, err := fdLn.Accept()
+		if err != nil {
+			break
+		}
+		err = sendConn(sender, id, conn)
+		_ = conn.Close()
+		if err != nil {
+			u.l.Warn("can't hand off connection", "id", id, "err", err)
+			break
+		}
+		handedOff++
+	}
+	_ = ln.Close()
+	u.l.Info("stopped handing off connections to new owner", "id", id, "conns", handedOff)
+}
+
+// sendConn sends conn to the next owner.
+func sendConn(sender *backlogSender, id string, conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T doesn't implement syscall.Conn", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	if err := raw.Control(func(fd uintptr) {
+		sendErr = sender.send(id, int(fd))
+	}); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// receiveBacklog asks the previous owner for the backlogs of the given
+// listeners, then receives connections until it closes the connection, and
+// delivers them.
+func (u *Upgrader) receiveBacklog(conn *net.UnixConn, ids []string) {
+	defer func() { _ = conn.Close() }()
+	if err := setNonblock(conn); err != nil {
+		u.l.Error("can't receive handed off connections", "err", err)
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	if err := proto.WriteJSONBlob(conn, proto.BacklogRequest{IDs: ids}); err != nil {
+		u.l.Error("can't request backlogs from previous owner", "err", err)
+		return
+	}
+
+	for {
+		var msg proto.BacklogConn
+		if err := proto.ReadJSONBlob(conn, &msg); err != nil {
+			u.l.Debug("previous owner stopped handing off connections", "err", err)
+			return
+		}
+		c, err := recvConn(conn)
+		if err != nil {
+			u.l.Error("error receiving handed off connection", "id", msg.ID, "err", err)
+			return
+		}
+		u.Fds.deliverBacklog(msg.ID, c)
+	}
+}
+
+// recvConn receives a connection sent along with its id by
+// backlogSender.send.
+func recvConn(conn *net.UnixConn) (net.Conn, error) {
+	name := make([]byte, maxNameLen)
+	oob := make([]byte, oobSpace)
+	n, oobn, _, _, err := conn.ReadMsgUnix(name, oob)
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxNameLen || oobn != oobSpace {
+		return nil, fmt.Errorf("incorrect number of bytes read (n=%d oobn=%d)", n, oobn)
+	}
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(scms) != 1 {
+		return nil, fmt.Errorf("number of SCMs is not 1: %d", len(scms))
+	}
+	fds, err := unix.ParseUnixRights(&scms[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("number of fds is not 1: %d", len(fds))
+	}
+	f := os.NewFile(uintptr(fds[0]), string(name[:n]))
+	defer func() { _ = f.Close() }()
+	return net.FileConn(f)
+}
+
+// setNonblock puts conn back into non-blocking mode, after an *os.File
+// sharing its file description was put into blocking mode, so that reads and
+// writes on it can be interrupted by closing it.
+func setNonblock(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var nbErr error
+	if err := raw.Control(func(fd uintptr) {
+		nbErr = unix.SetNonblock(int(fd), true)
+	}); err != nil {
+		return err
+	}
+	return nbErr
+}
+
+// closeBacklog stops handing off or receiving connections.
+func (u *Upgrader) closeBacklog() {
+	u.backlogLock.Lock()
+	defer u.backlogLock.Unlock()
+	if u.backlogSender != nil {
+		_ = u.backlogSender.Close()
+	}
+	if u.backlogReceiver != nil {
+		_ = u.backlogReceiver.Close()
+	}
+}
+
+// deliverBacklog delivers a connection handed off by the previous owner to the
+// listener registered for its id, or the backlog handler. If there is neither,
+// the connection is closed.
+func (f *Fds) deliverBacklog(id string, conn net.Conn) {
+	f.mu.Lock()
+	sink, ok := f.backlogSinks[id]
+	handler := f.backlogHandler
+	f.mu.Unlock()
+	switch {
+	case ok:
+		sink.inject(conn)
+	case handler != nil:
+		handler(id, conn)
+	default:
+		f.l.Warn("no listener for handed off connection, closing it", "id", id)
+		_ = conn.Close()
+	}
+}
+
+// addBacklogSinkLocked wraps ln so it accepts connections handed off for the
+// given id.
+func (f *Fds) addBacklogSinkLocked(id string, ln net.Listener) net.Listener {
+	sink := newBacklogListener(ln)
+	f.backlogSinks[id] = sink
+	return sink
+}
+
+// takeDroppedListeners returns the ids of the inherited listeners which were
+// closed at Ready.
+func (f *Fds) takeDroppedListeners() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := f.droppedListeners
+	f.droppedListeners = nil
+	return ids
+}
+
+// findBacklogListener returns the backlogListener in ln's chain of wrapped
+// listeners, if any.
+func findBacklogListener(ln net.Listener) *backlogListener {
+	for {
+		if bl, ok := ln.(*backlogListener); ok {
+			return bl
+		}
+		wrapper, ok := ln.(interface{ Unwrap() net.Listener })
+		if !ok {
+			return nil
+		}
+		ln = wrapper.Unwrap()
+	}
+}
+
+// backlogListener is a listener which, besides accepting from the wrapped
+// listener, accepts connections handed off by the previous owner.
+type backlogListener struct {
+	net.Listener
+
+	injected  chan net.Conn
+	accepted  chan acceptResult
+	startOnce sync.Once
+	// done is closed once acceptLoop returned, or if it never started
+	done      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	// diverting is closed once divert is set, after which accepted
+	// connections are passed to it instead of Accept
+	diverting  chan struct{}
+	divert     func(net.Conn)
+	divertOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newBacklogListener(ln net.Listener) *backlogListener {
+	return &backlogListener{
+		Listener:  ln,
+		injected:  make(chan net.Conn),
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+		diverting: make(chan struct{}),
+	}
+}
+
+func (l *backlogListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.injected:
+		return conn, nil
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *backlogListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		select {
+		case <-l.diverting:
+			if conn != nil {
+				l.divert(conn)
+			}
+		default:
+			select {
+			case l.accepted <- acceptResult{conn, err}:
+			case <-l.diverting:
+				if conn != nil {
+					l.divert(conn)
+				}
+			case <-l.closed:
+				if conn != nil {
+					_ = conn.Close()
+				}
+				return
+			}
+		}
+		if errors.Is(err, net.ErrClosed) {
+			l.closeOnce.Do(func() { close(l.closed) })
+			return
+		}
+	}
+}
+
+// divertTo passes the connections accepted from the wrapped listener from now
+// on to fn instead of Accept, including one accepted but not yet returned.
+func (l *backlogListener) divertTo(fn func(net.Conn)) {
+	l.divertOnce.Do(func() {
+		l.divert = fn
+		close(l.diverting)
+	})
+}
+
+// waitAccepting waits for the accept loop, if it was started, to stop once
+// the listener was closed.
+func (l *backlogListener) waitAccepting() {
+	l.startOnce.Do(func() { close(l.done) })
+	<-l.done
+}
+
+func (l *backlogListener) inject(conn net.Conn) {
+	select {
+	case l.injected <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+func (l *backlogListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// Unwrap returns the wrapped listener.
+func (l *backlogListener) Unwrap() net.Listener {
+	return l.Listener
+}
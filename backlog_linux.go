@@ -0,0 +1,108 @@
+package tableroll
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// steerReusePortGroup makes the SO_REUSEPORT group of the listening socket fd,
+// if it's in one, route new connections to the new owner's socket, so that
+// none are queued on fd while its backlog is handed off. It reports whether
+// the socket is in a group.
+//
+// The sockets of a group are indexed in the order they joined it, and closing
+// one moves the last one in its place. Once previous owners closed theirs, the
+// group holds this process' socket, then the one the new owner bound with
+// ListenOverlap, at index 1. While an owner before the previous one still
+// holds its socket, such as one which is still draining, index 1 may be any
+// socket of the group, so the group isn't steered unless it holds exactly two
+// sockets. A socket alone in its group isn't considered to be in one.
+func steerReusePortGroup(fd int) (bool, error) {
+	reusePort, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
+	if err != nil || reusePort == 0 {
+		return false, err
+	}
+	size, err := reusePortGroupSize(fd)
+	if err != nil {
+		return true, fmt.Errorf("can't determine the size of the SO_REUSEPORT group: %w", err)
+	}
+	switch {
+	case size <= 1:
+		return false, nil
+	case size > 2:
+		return true, fmt.Errorf("the SO_REUSEPORT group holds %d sockets, more than this process' and the new owner's", size)
+	}
+	return true, selectReusePortSocket(fd, 1)
+}
+
+// reusePortGroupSize returns the number of listening TCP sockets bound to the
+// same address as the listening socket fd, according to /proc/net. These
+// form its SO_REUSEPORT group, since binding them requires one.
+func reusePortGroupSize(fd int) (int, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return 0, err
+	}
+	// /proc/net/tcp shows addresses as 32-bit words in host byte order, and
+	// ports in hex
+	var table, addr string
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		table = "/proc/net/tcp"
+		addr = fmt.Sprintf("%08X:%04X", binary.NativeEndian.Uint32(sa.Addr[:]), sa.Port)
+	case *unix.SockaddrInet6:
+		table = "/proc/net/tcp6"
+		for i := 0; i < len(sa.Addr); i += 4 {
+			addr += fmt.Sprintf("%08X", binary.NativeEndian.Uint32(sa.Addr[i:i+4]))
+		}
+		addr += fmt.Sprintf(":%04X", sa.Port)
+	default:
+		return 0, fmt.Errorf("unsupported address %T", sa)
+	}
+
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "0: 0100007F:1F90 00000000:0000 0A ...", where 0A is LISTEN
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 3 && fields[1] == addr && fields[3] == "0A" {
+			size++
+		}
+	}
+	return size, scanner.Err()
+}
+
+// unsteerReusePortGroup undoes the routing a previous owner's HandOffBacklog
+// left on the SO_REUSEPORT group of the listening socket fd, which would
+// otherwise route every connection to the socket which joined the group last.
+func unsteerReusePortGroup(fd int) error {
+	// the kernel picks a socket by hash for an index out of range
+	err := selectReusePortSocket(fd, math.MaxUint32)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOPROTOOPT) {
+		// nothing could have been attached either
+		return nil
+	}
+	return err
+}
+
+// selectReusePortSocket makes the SO_REUSEPORT group of the listening socket
+// fd route new connections to its socket at the given index.
+func selectReusePortSocket(fd int, index uint32) error {
+	prog := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: index}}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	})
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package tableroll
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSteerReusePortGroupSize(t *testing.T) {
+	reusePort := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+		},
+	}
+	steer := func(ln net.Listener) (bool, error) {
+		return steerReusePortGroup(fdOf(t, ln))
+	}
+
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(addr, func(t *testing.T) {
+			ln1, err := reusePort.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Skipf("can't listen on %v: %v", addr, err)
+			}
+			defer func() { _ = ln1.Close() }()
+			// a socket alone in its group isn't steered
+			inGroup, err := steer(ln1)
+			require.NoError(t, err)
+			require.False(t, inGroup)
+
+			var lns []net.Listener
+			for range 2 {
+				ln, err := reusePort.Listen(context.Background(), "tcp", ln1.Addr().String())
+				require.NoError(t, err)
+				defer func() { _ = ln.Close() }()
+				lns = append(lns, ln)
+			}
+			size, err := reusePortGroupSize(fdOf(t, ln1))
+			require.NoError(t, err)
+			require.Equal(t, 3, size)
+			// index 1 isn't known to be the new owner's socket
+			inGroup, err = steer(ln1)
+			require.True(t, inGroup)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "holds 3 sockets")
+
+			_ = lns[1].Close()
+			size, err = reusePortGroupSize(fdOf(t, ln1))
+			require.NoError(t, err)
+			require.Equal(t, 2, size)
+		})
+	}
+}
+
+func fdOf(t *testing.T, ln net.Listener) int {
+	raw, err := ln.(*net.TCPListener).SyscallConn()
+	require.NoError(t, err)
+	var sockFd int
+	require.NoError(t, raw.Control(func(fd uintptr) { sockFd = int(fd) }))
+	return sockFd
+}
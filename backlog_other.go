@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tableroll
+
+// steerReusePortGroup can't route connections within a SO_REUSEPORT group on
+// this platform.
+func steerReusePortGroup(int) (bool, error) {
+	return false, nil
+}
+
+func unsteerReusePortGroup(int) error {
+	return nil
+}
@@ -0,0 +1,161 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+// dialQueued dials addr n times without anyone accepting, so the connections
+// wait in the listener's accept queue, and writes the index on each.
+func dialQueued(t *testing.T, addr string, n int) {
+	for i := range n {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		_, err = conn.Write([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+}
+
+func readIndex(t *testing.T, conn net.Conn) int {
+	b := make([]byte, 1)
+	_, err := conn.Read(b)
+	require.NoError(t, err)
+	_ = conn.Close()
+	return int(b[0])
+}
+
+func TestHandOffBacklogOfRemovedListener(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	removed, err := upg1.Fds.Listen(ctx, "removed", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	kept, err := upg1.Fds.Listen(ctx, "kept", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	handledIDs := make(chan string, 10)
+	handled := make(chan net.Conn, 10)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithBacklogHandler(func(id string, conn net.Conn) {
+			handledIDs <- id
+			handled <- conn
+		}))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	kept2, err := upg2.Fds.Listener("kept")
+	require.NoError(t, err)
+	defer func() { _ = kept2.Close() }()
+
+	dialQueued(t, removed.Addr().String(), 3)
+	dialQueued(t, kept.Addr().String(), 3)
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	require.NoError(t, upg1.HandOffBacklog("removed", removed))
+	require.NoError(t, upg1.HandOffBacklog("kept", kept))
+
+	for i := range 3 {
+		require.Equal(t, "removed", <-handledIDs)
+		require.Equal(t, i, readIndex(t, <-handled))
+	}
+	// the kept listener's queue was left alone for the new owner
+	for i := range 3 {
+		conn, err := kept2.Accept()
+		require.NoError(t, err)
+		require.Equal(t, i, readIndex(t, conn))
+	}
+}
+
+func TestHandOffBacklogOfChangedAddress(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	oldLn, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")), WithListenerAddressReconciliation())
+	require.NoError(t, err)
+	defer upg2.Stop()
+	newLn, err := upg2.Fds.Listen(ctx, "ln", nil, "tcp", "localhost:0")
+	require.NoError(t, err)
+	defer func() { _ = newLn.Close() }()
+
+	dialQueued(t, oldLn.Addr().String(), 3)
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	require.NoError(t, upg1.HandOffBacklog("ln", oldLn))
+
+	for i := range 3 {
+		conn, err := newLn.Accept()
+		require.NoError(t, err)
+		require.Equal(t, i, readIndex(t, conn))
+	}
+}
+
+// TestHandOffBacklogOfReplacingListener hands off the backlog of a listener
+// which itself replaced an inherited one, and so accepts in the background.
+func TestHandOffBacklogOfReplacingListener(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	_, err = upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")), WithListenerAddressReconciliation())
+	require.NoError(t, err)
+	defer upg2.Stop()
+	ln, err := upg2.Fds.Listen(ctx, "ln", nil, "tcp", "localhost:0")
+	require.NoError(t, err)
+	require.IsType(t, &backlogListener{}, ln)
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+
+	// serve one connection, which leaves the listener accepting the next one
+	// in the background
+	dialQueued(t, ln.Addr().String(), 1)
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	require.Equal(t, 0, readIndex(t, conn))
+	dialQueued(t, ln.Addr().String(), 3)
+	// give the listener time to accept one of them
+	time.Sleep(50 * time.Millisecond)
+
+	handled := make(chan net.Conn, 10)
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")),
+		WithBacklogHandler(func(id string, conn net.Conn) {
+			handled <- conn
+		}))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	require.NoError(t, upg3.Ready())
+	<-upg2.UpgradeComplete()
+	require.NoError(t, upg2.HandOffBacklog("ln", ln))
+
+	var indexes []int
+	for range 3 {
+		select {
+		case conn := <-handled:
+			indexes = append(indexes, readIndex(t, conn))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got connections %v", indexes)
+		}
+	}
+	require.ElementsMatch(t, []int{0, 1, 2}, indexes)
+}
@@ -0,0 +1,198 @@
+// Command tablerollctl inspects a tableroll coordination directory.
+//
+// Usage:
+//
+//	tablerollctl -dir /run/myapp/tableroll [-group name] <command>
+//
+// Commands:
+//
+//	status   show the owner and its state, the lock holder and stale sockets
+//	fds      list the file descriptors held by the owner
+//	watch    stream the owner's events, following it across upgrades
+//	cleanup  remove upgrade sockets of processes which crashed
+//	groups   list the groups in the directory
+//
+// Commands other than groups apply to the default group unless -group is set.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+func main() {
+	flags := flag.NewFlagSet("tablerollctl", flag.ExitOnError)
+	dir := flags.String("dir", "", "tableroll coordination directory")
+	group := flags.String("group", "", "group within the coordination directory, see tableroll.WithGroup")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout for commands other than watch")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: tablerollctl -dir DIR [-group NAME] status|fds|watch|cleanup|groups\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+	if *dir == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	cmd := flags.Arg(0)
+	if cmd != "watch" {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	opt := tableroll.InGroup(*group)
+	var err error
+	switch cmd {
+	case "status":
+		err = status(ctx, *dir, opt)
+	case "fds":
+		err = fds(ctx, *dir, opt)
+	case "watch":
+		err = watch(ctx, *dir, opt)
+	case "cleanup":
+		err = cleanup(ctx, *dir, opt)
+	case "groups":
+		err = groups(*dir)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tablerollctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func status(ctx context.Context, dir string, opt tableroll.QueryOption) error {
+	st, err := tableroll.InspectDir(ctx, dir, opt)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if st.OwnerID == "" {
+		fmt.Fprintf(w, "owner:\tnone\n")
+	} else {
+		fmt.Fprintf(w, "owner:\t%s\n", st.OwnerID)
+		fmt.Fprintf(w, "listening:\t%v\n", st.OwnerListening)
+	}
+	if st.OwnerListening {
+		owner, err := tableroll.QueryStatus(ctx, dir, opt)
+		if err != nil {
+			fmt.Fprintf(w, "state:\tunknown (%v)\n", err)
+		} else {
+			if owner.AppVersion != "" {
+				fmt.Fprintf(w, "app version:\t%s\n", owner.AppVersion)
+			}
+			for _, k := range slices.Sorted(maps.Keys(owner.Labels)) {
+				fmt.Fprintf(w, "label:\t%s=%s\n", k, owner.Labels[k])
+			}
+			fmt.Fprintf(w, "state:\t%s\n", owner.State)
+			fmt.Fprintf(w, "protocol version:\t%d\n", owner.ProtocolVersion)
+			fmt.Fprintf(w, "fds:\t%d\n", owner.Fds)
+			fmt.Fprintf(w, "upgrade in progress:\t%v\n", owner.UpgradeInProgress)
+		}
+	}
+	switch {
+	case !st.Locked:
+		fmt.Fprintf(w, "locked:\tno\n")
+	case st.LockHolderPID != 0:
+		fmt.Fprintf(w, "locked:\tyes, by pid %d\n", st.LockHolderPID)
+	default:
+		fmt.Fprintf(w, "locked:\tyes\n")
+	}
+	fmt.Fprintf(w, "stale sockets:\t%d\n", len(st.StaleSockets))
+	for _, path := range st.StaleSockets {
+		fmt.Fprintf(w, "\t%s\n", path)
+	}
+	return w.Flush()
+}
+
+func fds(ctx context.Context, dir string, opt tableroll.QueryOption) error {
+	items, err := tableroll.QueryFds(ctx, dir, opt)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tKIND\tNETWORK\tADDR\n")
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.ID, item.Kind, item.Network, item.Addr)
+	}
+	return w.Flush()
+}
+
+func watch(ctx context.Context, dir string, opt tableroll.QueryOption) error {
+	for {
+		err := tableroll.WatchEvents(ctx, dir, printEvent, opt)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tablerollctl: %v, retrying\n", err)
+		}
+		// the owner stepped down or isn't reachable, follow the next one
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func printEvent(ev tableroll.Event) {
+	line := fmt.Sprintf("%s %s", ev.Time.Format(time.RFC3339Nano), ev.Type)
+	if ev.Peer.ID != "" {
+		line += fmt.Sprintf(" peer=%s", ev.Peer.ID)
+		if ev.Peer.AppVersion != "" {
+			line += fmt.Sprintf(" peerVersion=%s", ev.Peer.AppVersion)
+		}
+	}
+	if ev.Listener != nil {
+		line += fmt.Sprintf(" listener=%s addr=%s/%s->%s/%s",
+			ev.Listener.ID, ev.Listener.OldNetwork, ev.Listener.OldAddr, ev.Listener.Network, ev.Listener.Addr)
+	}
+	if ev.Err != nil {
+		line += fmt.Sprintf(" err=%q", ev.Err)
+	}
+	fmt.Println(line)
+}
+
+func cleanup(ctx context.Context, dir string, opt tableroll.QueryOption) error {
+	removed, err := tableroll.CleanupDir(ctx, dir, opt)
+	for _, path := range removed {
+		fmt.Printf("removed %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		fmt.Println("no stale sockets")
+	}
+	return nil
+}
+
+func groups(dir string) error {
+	names, err := tableroll.ListGroups(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Println("no groups")
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
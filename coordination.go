@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/euank/filelock"
@@ -29,7 +30,12 @@ type coordinator struct {
 	lock *filelock.FileLock
 	dir  string
 	id   string
-	l    *slog.Logger
+	// group is the upgrade chain within dir, or empty for the default one, see
+	// WithGroup
+	group string
+	l     *slog.Logger
+	// fault is called at fault points, see WithFaultHook
+	fault FaultHook
 
 	// mocks
 	clock clock.Clock
@@ -42,7 +48,12 @@ func newCoordinator(clock clock.Clock, l *slog.Logger, dir string, id string) *c
 }
 
 func (c *coordinator) Listen(ctx context.Context) (*net.UnixListener, error) {
-	listenpath := upgradeSockPath(c.dir, c.id)
+	if c.group != "" {
+		if err := os.MkdirAll(c.sockDir(), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	listenpath := c.sockPath(c.id)
 	l, err := (&net.ListenConfig{}).Listen(ctx, "unix", listenpath)
 	if err != nil {
 		return nil, err
@@ -85,17 +96,45 @@ func (c *coordinator) Lock(ctx context.Context) error {
 	}
 	c.l.Info("took lock on coordination dir")
 	c.lock = flock
-	return ctx.Err()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.fault.at(FaultLocked); err != nil {
+		_ = c.Unlock()
+		return err
+	}
+	return nil
 }
 
 func (c *coordinator) idFile() string {
 	// named 'pid' for historical reasons, originally the opaque id was always a pid
+	if c.group != "" {
+		return filepath.Join(c.dir, groupIDFilePrefix+c.group)
+	}
 	return filepath.Join(c.dir, "pid")
 }
 
+// sockDir returns the directory holding the upgrade sockets of the
+// coordinator's group.
+func (c *coordinator) sockDir() string {
+	if c.group != "" {
+		return filepath.Join(c.dir, c.group)
+	}
+	return c.dir
+}
+
+// sockPath returns the path of the upgrade socket of the process with the
+// given id in the coordinator's group.
+func (c *coordinator) sockPath(id string) string {
+	return upgradeSockPath(c.sockDir(), id)
+}
+
 // BecomeOwner marks this coordinator as the owner of the coordination directory.
 // It should only be called while the lock is held.
 func (c *coordinator) BecomeOwner() error {
+	if err := c.fault.at(FaultBecomeOwner); err != nil {
+		return err
+	}
 	c.l.Info("writing id to become owner", "id", c.id)
 	return os.WriteFile(c.idFile(), []byte(c.id), 0o755)
 }
@@ -133,7 +172,7 @@ func (c *coordinator) ConnectOwner(ctx context.Context) (*net.UnixConn, error) {
 	}
 	c.l.Info("connecting to owner", "owner", oid)
 
-	sockPath := upgradeSockPath(c.dir, oid)
+	sockPath := c.sockPath(oid)
 	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
 	if err != nil {
 		if isContextDialErr(err) {
@@ -156,3 +195,31 @@ func isContextDialErr(err error) bool {
 func upgradeSockPath(coordinationDir string, oid string) string {
 	return filepath.Join(coordinationDir, fmt.Sprintf("%s.sock", oid))
 }
+
+// IsLocked reports whether another process holds the lock on the coordination
+// directory, which is the case while it's taking over from the owner. It
+// doesn't take the lock itself where the platform allows it.
+func (c *coordinator) IsLocked() (bool, error) {
+	locked, err := flocked(c.idFile())
+	if os.IsNotExist(err) || err == filelock.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "can't check the lock on the coordination directory")
+	}
+	return locked, nil
+}
+
+// Sockets returns the paths of the upgrade sockets of the coordinator's group,
+// keyed by process id.
+func (c *coordinator) Sockets() (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(c.sockDir(), "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	socks := make(map[string]string, len(paths))
+	for _, path := range paths {
+		socks[strings.TrimSuffix(filepath.Base(path), ".sock")] = path
+	}
+	return socks, nil
+}
@@ -0,0 +1,352 @@
+package tableroll
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+const (
+	// DefaultDrainPhaseTimeout is how long a Drainer waits for the steps of a
+	// phase to finish before moving on to the next phase.
+	DefaultDrainPhaseTimeout time.Duration = 10 * time.Second
+	// DefaultDrainTimeout is how long a Drainer waits for all steps and
+	// in-flight work to finish before force-closing what's left.
+	DefaultDrainTimeout time.Duration = 30 * time.Second
+)
+
+// DrainStep is a unit of work run by a Drainer once an upgrade has completed,
+// such as closing a listener or shutting down a server.
+type DrainStep struct {
+	// Name identifies the step in logs and the DrainReport.
+	Name string
+	// Priority orders steps: all steps with the lowest priority run
+	// concurrently as the first phase, followed by the next priority, and so on.
+	Priority int
+	// Drain gracefully drains the resource. Its context is cancelled at the
+	// Drainer's hard deadline.
+	Drain func(ctx context.Context) error
+	// Force, if set, is called at the hard deadline if Drain failed or has not
+	// yet returned, e.g. to close any remaining connections.
+	Force func() error
+}
+
+// DrainStepResult describes the outcome of a single DrainStep.
+type DrainStepResult struct {
+	Name     string
+	Priority int
+	// Duration is how long after draining started the step finished.
+	Duration time.Duration
+	// Err is the error returned by Drain, or the context error if Drain had not
+	// returned by the hard deadline.
+	Err error
+	// Forced is true if the step's Force function was called.
+	Forced bool
+	// ForceErr is the error returned by Force.
+	ForceErr error
+}
+
+// DrainReport describes the outcome of draining.
+type DrainReport struct {
+	Steps []DrainStepResult
+	// InFlight lists the work registered with Drainer.Track which had not
+	// finished by the hard deadline.
+	InFlight []string
+}
+
+// DrainerOption is an option function for Drainer.
+type DrainerOption func(d *Drainer)
+
+// WithDefaultPhaseTimeout configures how long the Drainer waits for a phase
+// to finish before starting the next one, for phases without a timeout
+// configured through WithPhaseTimeout.
+func WithDefaultPhaseTimeout(t time.Duration) DrainerOption {
+	return func(d *Drainer) {
+		d.defaultPhaseTimeout = t
+	}
+}
+
+// WithPhaseTimeout configures how long the Drainer waits for the phase of the
+// given priority to finish before starting the next one.
+func WithPhaseTimeout(priority int, t time.Duration) DrainerOption {
+	return func(d *Drainer) {
+		d.phaseTimeouts[priority] = t
+	}
+}
+
+// WithDrainTimeout configures the hard deadline after which steps which did
+// not finish are forced.
+func WithDrainTimeout(t time.Duration) DrainerOption {
+	return func(d *Drainer) {
+		d.timeout = t
+	}
+}
+
+// Drainer runs registered drain steps once an upgrade has completed, and
+// reports what was still in flight at its hard deadline.
+type Drainer struct {
+	upg *Upgrader
+
+	defaultPhaseTimeout time.Duration
+	phaseTimeouts       map[int]time.Duration
+	timeout             time.Duration
+
+	mu       sync.Mutex
+	steps    []DrainStep
+	inFlight map[*string]struct{}
+	// idle is closed when inFlight becomes empty; nil while it is empty
+	idle chan struct{}
+
+	l *slog.Logger
+}
+
+// NewDrainer constructs a Drainer which drains once the given upgrader's
+// UpgradeComplete channel is closed.
+func NewDrainer(upg *Upgrader, opts ...DrainerOption) *Drainer {
+	d := &Drainer{
+		upg:                 upg,
+		defaultPhaseTimeout: DefaultDrainPhaseTimeout,
+		phaseTimeouts:       map[int]time.Duration{},
+		timeout:             DefaultDrainTimeout,
+		inFlight:            map[*string]struct{}{},
+		l:                   upg.l,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Add registers a drain step.
+func (d *Drainer) Add(step DrainStep) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.steps = append(d.steps, step)
+}
+
+// AddFunc registers a drain step which calls fn.
+func (d *Drainer) AddFunc(name string, priority int, fn func(ctx context.Context) error) {
+	d.Add(DrainStep{Name: name, Priority: priority, Drain: fn})
+}
+
+// AddCloser registers a drain step which closes c.
+func (d *Drainer) AddCloser(name string, priority int, c io.Closer) {
+	d.AddFunc(name, priority, func(context.Context) error {
+		return c.Close()
+	})
+}
+
+// AddListener registers a drain step which closes ln, such as a listener
+// retrieved from Fds.
+func (d *Drainer) AddListener(name string, priority int, ln net.Listener) {
+	d.AddCloser(name, priority, ln)
+}
+
+// AddListenerHandOff registers a drain step which closes ln, the listener with
+// the given id, using Upgrader.HandOffBacklog so connections waiting in its
+// accept queue aren't reset.
+func (d *Drainer) AddListenerHandOff(name string, priority int, id string, ln net.Listener) {
+	d.AddFunc(name, priority, func(context.Context) error {
+		err := d.upg.HandOffBacklog(id, ln)
+		if errors.Is(err, ErrBacklogHandOffUnsupported) {
+			// ln is closed regardless, which is all that can be done
+			return nil
+		}
+		return err
+	})
+}
+
+// AddHTTPServer registers a drain step which disables keep-alives and shuts
+// down srv, and closes its remaining connections at the hard deadline.
+func (d *Drainer) AddHTTPServer(name string, priority int, srv *http.Server) {
+	d.Add(DrainStep{
+		Name:     name,
+		Priority: priority,
+		Drain: func(ctx context.Context) error {
+			srv.SetKeepAlivesEnabled(false)
+			return srv.Shutdown(ctx)
+		},
+		Force: srv.Close,
+	})
+}
+
+// Track registers in-flight work which draining should wait for. The returned
+// function must be called once the work is done.
+func (d *Drainer) Track(name string) (done func()) {
+	key := &name
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight[key] = struct{}{}
+	if d.idle == nil {
+		d.idle = make(chan struct{})
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			delete(d.inFlight, key)
+			if len(d.inFlight) == 0 {
+				close(d.idle)
+				d.idle = nil
+			}
+		})
+	}
+}
+
+// Wait waits for the upgrade to complete and then drains. If ctx is cancelled
+// before the upgrade completes, nothing is drained and the context error is
+// returned.
+func (d *Drainer) Wait(ctx context.Context) (*DrainReport, error) {
+	select {
+	case <-d.upg.UpgradeComplete():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return d.Drain(), nil
+}
+
+// Drain runs all registered steps in order of priority, waits for in-flight
+// work, and forces whatever hasn't finished by the hard deadline.
+func (d *Drainer) Drain() *DrainReport {
+	d.mu.Lock()
+	steps := slices.Clone(d.steps)
+	d.mu.Unlock()
+	slices.SortStableFunc(steps, func(a, b DrainStep) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+
+	clk := d.upg.clock
+	ctx, cancel := withClockTimeout(clk, d.timeout)
+	defer cancel()
+	start := clk.Now()
+
+	type outcome struct {
+		err      error
+		duration time.Duration
+	}
+	outcomes := make([]outcome, len(steps))
+	finished := make([]chan struct{}, len(steps))
+	for phaseStart := 0; phaseStart < len(steps); {
+		priority := steps[phaseStart].Priority
+		phaseEnd := phaseStart
+		for phaseEnd < len(steps) && steps[phaseEnd].Priority == priority {
+			phaseEnd++
+		}
+		d.l.Info("draining phase", "priority", priority, "steps", phaseEnd-phaseStart)
+		for i := phaseStart; i < phaseEnd; i++ {
+			finished[i] = make(chan struct{})
+			go func() {
+				defer close(finished[i])
+				err := steps[i].Drain(ctx)
+				outcomes[i] = outcome{err: err, duration: clk.Since(start)}
+			}()
+		}
+
+		phaseTimeout, ok := d.phaseTimeouts[priority]
+		if !ok {
+			phaseTimeout = d.defaultPhaseTimeout
+		}
+		phaseDeadline := clk.NewTimer(phaseTimeout)
+	waitPhase:
+		for i := phaseStart; i < phaseEnd; i++ {
+			select {
+			case <-finished[i]:
+			case <-phaseDeadline.C():
+				d.l.Warn("drain phase timed out, continuing with the next one", "priority", priority)
+				break waitPhase
+			case <-ctx.Done():
+				break waitPhase
+			}
+		}
+		phaseDeadline.Stop()
+		phaseStart = phaseEnd
+	}
+
+	// Wait for in-flight work, then for any steps which outlived their phase,
+	// up until the hard deadline.
+	report := &DrainReport{}
+	d.mu.Lock()
+	idle := d.idle
+	d.mu.Unlock()
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+		}
+	}
+	d.mu.Lock()
+	for name := range d.inFlight {
+		report.InFlight = append(report.InFlight, *name)
+	}
+	d.mu.Unlock()
+	slices.Sort(report.InFlight)
+	if len(report.InFlight) > 0 {
+		d.l.Warn("work still in flight after draining", "inFlight", report.InFlight)
+	}
+
+	for i, step := range steps {
+		result := DrainStepResult{Name: step.Name, Priority: step.Priority}
+		select {
+		case <-finished[i]:
+		case <-ctx.Done():
+		}
+		// Check again, since select picks either if the step finished by the
+		// time the deadline passed.
+		select {
+		case <-finished[i]:
+			result.Err = outcomes[i].err
+			result.Duration = outcomes[i].duration
+		default:
+			// Still running at the hard deadline. Its context is cancelled by now,
+			// but don't wait for it to notice before forcing.
+			result.Err = ctx.Err()
+			result.Duration = clk.Since(start)
+		}
+		if result.Err != nil && step.Force != nil {
+			d.l.Warn("forcing drain step", "name", step.Name, "err", result.Err)
+			result.Forced = true
+			result.ForceErr = step.Force()
+		}
+		report.Steps = append(report.Steps, result)
+	}
+	return report
+}
+
+// clockTimeoutCtx is like a context with a timeout, but times out according
+// to a clock.Clock.
+type clockTimeoutCtx struct {
+	context.Context
+}
+
+func withClockTimeout(clk clock.Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	timer := clk.NewTimer(timeout)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return clockTimeoutCtx{ctx}, func() { cancel(nil) }
+}
+
+// Err returns context.DeadlineExceeded once timed out, as the contexts of the
+// context package do.
+func (c clockTimeoutCtx) Err() error {
+	if c.Context.Err() == nil {
+		return nil
+	}
+	return context.Cause(c.Context)
+}
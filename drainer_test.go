@@ -0,0 +1,160 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+	fakeclock "k8s.io/utils/clock/testing"
+)
+
+func TestDrainerPhases(t *testing.T) {
+	ctx := context.Background()
+	upg, err := newUpgrader(ctx, clock.RealClock{}, tmpDir(t), "1", WithLogger(l))
+	require.NoError(t, err)
+	require.NoError(t, upg.Ready())
+
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	d := NewDrainer(upg)
+	d.AddFunc("last", 2, record("last"))
+	d.AddFunc("first", 0, record("first"))
+	d.AddListener("ln", 1, ln)
+	d.AddFunc("middle", 1, record("middle"))
+
+	upg.Stop()
+	report, err := d.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "middle", "last"}, order)
+	require.Empty(t, report.InFlight)
+	for _, step := range report.Steps {
+		require.NoError(t, step.Err, step.Name)
+		require.False(t, step.Forced, step.Name)
+	}
+	_, err = ln.Accept()
+	require.True(t, errors.Is(err, net.ErrClosed), "expected listener to be closed, got %v", err)
+}
+
+func TestDrainerForcesAtDeadline(t *testing.T) {
+	ctx := context.Background()
+	upg, err := newUpgrader(ctx, clock.RealClock{}, tmpDir(t), "1", WithLogger(l))
+	require.NoError(t, err)
+	require.NoError(t, upg.Ready())
+
+	d := NewDrainer(upg, WithDrainTimeout(50*time.Millisecond), WithPhaseTimeout(0, 10*time.Millisecond))
+	forced := make(chan struct{})
+	d.Add(DrainStep{
+		Name: "stuck",
+		Drain: func(ctx context.Context) error {
+			<-forced
+			return nil
+		},
+		Force: func() error {
+			close(forced)
+			return nil
+		},
+	})
+	secondPhase := make(chan struct{})
+	d.AddFunc("second", 1, func(context.Context) error {
+		close(secondPhase)
+		return nil
+	})
+	done := d.Track("request")
+	defer done()
+	finished := d.Track("finished")
+	finished()
+
+	upg.Stop()
+	report, err := d.Wait(ctx)
+	require.NoError(t, err)
+	<-secondPhase
+	require.Equal(t, []string{"request"}, report.InFlight)
+	require.Len(t, report.Steps, 2)
+	require.Equal(t, "stuck", report.Steps[0].Name)
+	require.True(t, report.Steps[0].Forced)
+	require.Equal(t, context.DeadlineExceeded, report.Steps[0].Err)
+	require.False(t, report.Steps[1].Forced)
+}
+
+func TestDrainerDeadlineAfterStepsFinished(t *testing.T) {
+	ctx := context.Background()
+	clk := fakeclock.NewFakeClock(time.Now())
+	upg, err := newUpgrader(ctx, clk, tmpDir(t), "1", WithLogger(l))
+	require.NoError(t, err)
+	require.NoError(t, upg.Ready())
+
+	d := NewDrainer(upg, WithDrainTimeout(time.Minute))
+	var drained sync.WaitGroup
+	const numSteps = 20
+	for i := range numSteps {
+		drained.Add(1)
+		d.Add(DrainStep{
+			Name: strconv.Itoa(i),
+			Drain: func(context.Context) error {
+				drained.Done()
+				return nil
+			},
+			Force: func() error {
+				t.Errorf("step %v finished but was forced", i)
+				return nil
+			},
+		})
+	}
+	// in-flight work keeps draining going until the deadline
+	done := d.Track("request")
+	defer done()
+
+	upg.Stop()
+	reportC := make(chan *DrainReport)
+	go func() {
+		report, _ := d.Wait(ctx)
+		reportC <- report
+	}()
+	drained.Wait()
+	for !clk.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Step(time.Minute)
+	report := <-reportC
+	require.Equal(t, []string{"request"}, report.InFlight)
+	require.Len(t, report.Steps, numSteps)
+	for _, step := range report.Steps {
+		require.NoError(t, step.Err, step.Name)
+		require.False(t, step.Forced, step.Name)
+	}
+}
+
+func TestDrainerWaitCancelled(t *testing.T) {
+	ctx := context.Background()
+	upg, err := newUpgrader(ctx, clock.RealClock{}, tmpDir(t), "1", WithLogger(l))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	d := NewDrainer(upg)
+	d.AddFunc("never", 0, func(context.Context) error {
+		t.Error("should not drain before the upgrade completes")
+		return nil
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = d.Wait(ctx)
+	require.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,105 @@
+package tableroll
+
+import "time"
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventUpgradeRequested is emitted by the owner when a new process has
+	// received its file descriptors and introduced itself.
+	EventUpgradeRequested EventType = "upgrade-requested"
+	// EventUpgradeRejected is emitted by the owner when its UpgradeFilter
+	// refused an upgrade. The owner remains the owner.
+	EventUpgradeRejected EventType = "upgrade-rejected"
+	// EventUpgradeFailed is emitted by the owner when handing over its file
+	// descriptors failed. The owner remains the owner.
+	EventUpgradeFailed EventType = "upgrade-failed"
+	// EventSteppedDown is emitted by the previous owner once the new owner is
+	// ready, right before UpgradeComplete is closed.
+	EventSteppedDown EventType = "stepped-down"
+	// EventBecameOwner is emitted by a process when Ready made it the owner.
+	EventBecameOwner EventType = "became-owner"
+	// EventListenerAddressChanged is emitted when an inherited listener was
+	// replaced because its address changed, see
+	// WithListenerAddressReconciliation.
+	EventListenerAddressChanged EventType = "listener-address-changed"
+	// EventUpgradeTriggered is emitted by the owner when a signal triggered an
+	// upgrade, see Upgrader.TriggerOnSignal.
+	EventUpgradeTriggered EventType = "upgrade-triggered"
+	// EventUpgradeTriggerRefused is emitted by the owner when a signal was
+	// delivered while an upgrade was in progress.
+	EventUpgradeTriggerRefused EventType = "upgrade-trigger-refused"
+	// EventUpgradeTriggerFailed is emitted by the owner when the successor
+	// started by a triggered upgrade didn't take over.
+	EventUpgradeTriggerFailed EventType = "upgrade-trigger-failed"
+)
+
+// Event describes a step of an upgrade.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Peer is the other process taking part in the upgrade: for events emitted
+	// by the owner it is the process taking over, and for events emitted by the
+	// new owner it is the previous owner.
+	// Its fields are empty if there is no peer, or if the peer speaks a
+	// protocol version which doesn't exchange process information.
+	Peer ProcessInfo
+	// Err is the reason for EventUpgradeRejected, EventUpgradeFailed,
+	// EventUpgradeTriggerRefused and EventUpgradeTriggerFailed.
+	Err error
+	// Listener describes the change for EventListenerAddressChanged.
+	Listener *ListenerChange
+}
+
+// WithEventHandler configures a function which is called with each Event
+// emitted by the upgrader. The handler is called synchronously from the
+// goroutine performing the upgrade, so it should return quickly.
+func WithEventHandler(handler func(Event)) Option {
+	return func(u *Upgrader) {
+		u.eventHandler = handler
+	}
+}
+
+func (u *Upgrader) emit(ev Event) {
+	ev.Time = u.clock.Now()
+	u.publishEvent(ev)
+	if u.eventHandler == nil {
+		return
+	}
+	u.eventHandler(ev)
+}
+
+// eventSubscriberBuffer is how many events are buffered for a subscriber
+// before further events are dropped for it.
+const eventSubscriberBuffer = 64
+
+// subscribeEvents returns a channel receiving the events emitted from now on,
+// until the returned function is called.
+func (u *Upgrader) subscribeEvents() (<-chan Event, func()) {
+	events := make(chan Event, eventSubscriberBuffer)
+	u.eventLock.Lock()
+	if u.eventSubscribers == nil {
+		u.eventSubscribers = make(map[chan Event]struct{})
+	}
+	u.eventSubscribers[events] = struct{}{}
+	u.eventLock.Unlock()
+	return events, func() {
+		u.eventLock.Lock()
+		delete(u.eventSubscribers, events)
+		u.eventLock.Unlock()
+	}
+}
+
+// publishEvent passes ev to the subscribers.
+func (u *Upgrader) publishEvent(ev Event) {
+	u.eventLock.Lock()
+	defer u.eventLock.Unlock()
+	for sub := range u.eventSubscribers {
+		select {
+		case sub <- ev:
+		default:
+			u.l.Warn("event subscriber isn't keeping up, dropping event", "type", ev.Type)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package tableroll
+
+// FaultPoint identifies a step of the handoff protocol at which a FaultHook
+// is called.
+type FaultPoint string
+
+const (
+	// FaultOwnerSentMetadata is reached by the owner after it sent the
+	// metadata of its file descriptors to a new process, before sending the
+	// descriptors themselves. An error aborts the upgrade, and the owner
+	// remains the owner.
+	FaultOwnerSentMetadata FaultPoint = "owner-sent-metadata"
+	// FaultOwnerSteppingDown is reached by the owner right before it tells the
+	// new process that it steps down. An error closes the connection instead,
+	// as if the message was lost, but the owner steps down regardless.
+	FaultOwnerSteppingDown FaultPoint = "owner-stepping-down"
+	// FaultReceivedFiles is reached by a new process in New, once it received
+	// the owner's file descriptors. An error makes New fail, as if the process
+	// died before becoming ready.
+	FaultReceivedFiles FaultPoint = "received-files"
+	// FaultReadyHandshake is reached by a new process in Ready, before it
+	// notifies the owner. An error makes Ready fail.
+	FaultReadyHandshake FaultPoint = "ready-handshake"
+	// FaultLocked is reached by a new process once it locked the coordination
+	// directory, before looking up the owner. An error makes New fail.
+	FaultLocked FaultPoint = "locked"
+	// FaultBecomeOwner is reached by a new process in Ready before it records
+	// itself as the owner in the coordination directory. An error makes Ready
+	// fail.
+	FaultBecomeOwner FaultPoint = "become-owner"
+)
+
+// FaultHook is called at each FaultPoint a process reaches. Returning an error
+// injects a failure at that point, as described for each FaultPoint. The hook
+// may also act on the environment, such as deleting the coordination
+// directory's lock file at FaultLocked.
+type FaultHook func(point FaultPoint) error
+
+// WithFaultHook configures a hook which is called at each step of the handoff
+// protocol, to reproduce partial failures in tests. It should not be used in
+// production.
+func WithFaultHook(hook FaultHook) Option {
+	return func(u *Upgrader) {
+		u.faultHook = hook
+	}
+}
+
+// at calls the hook, if any, for the given point.
+func (h FaultHook) at(point FaultPoint) error {
+	if h == nil {
+		return nil
+	}
+	return h(point)
+}
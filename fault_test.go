@@ -0,0 +1,156 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+var errInjected = errors.New("injected fault")
+
+// failAt returns a fault hook which fails at the given point.
+func failAt(point FaultPoint) FaultHook {
+	return func(p FaultPoint) error {
+		if p == point {
+			return errInjected
+		}
+		return nil
+	}
+}
+
+// requireOwner checks that upg is still the owner, by checking that its fds
+// can be mutated and another process can take over from it.
+func requireOwner(t *testing.T, ctx context.Context, coordDir string, upg *Upgrader) {
+	awaitUpgradeAborted(t, ctx, coordDir, upg)
+	_, err := upg.Fds.Listen(ctx, "probe", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	next, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "next", WithLogger(l.With("pid", "next")))
+	require.NoError(t, err)
+	defer next.Stop()
+	ln, err := next.Fds.Listener("probe")
+	require.NoError(t, err)
+	require.NotNil(t, ln)
+	_ = ln.Close()
+	require.NoError(t, next.Ready())
+	<-upg.UpgradeComplete()
+}
+
+// awaitUpgradeAborted waits for upg, the owner, to notice that an upgrade
+// failed.
+func awaitUpgradeAborted(t *testing.T, ctx context.Context, coordDir string, upg *Upgrader) {
+	require.Eventually(t, func() bool {
+		status, err := QueryStatus(ctx, coordDir)
+		return err == nil && status.ID == upg.coord.id && !status.UpgradeInProgress
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFaultOwnerDiesAfterMetadata(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	var fault FaultHook
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithFaultHook(func(p FaultPoint) error { return fault.at(p) }))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	_, err = upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	fault = failAt(FaultOwnerSentMetadata)
+	_, err = newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.Error(t, err)
+
+	fault = nil
+	requireOwner(t, ctx, coordDir, upg1)
+}
+
+func TestFaultNewProcessDiesBeforeReady(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithFaultHook(failAt(FaultReceivedFiles)))
+	require.True(t, errors.Is(err, errInjected))
+	awaitUpgradeAborted(t, ctx, coordDir, upg1)
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")),
+		WithFaultHook(failAt(FaultReadyHandshake)))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	require.True(t, errors.Is(upg3.Ready(), errInjected))
+	upg3.Stop()
+
+	requireOwner(t, ctx, coordDir, upg1)
+}
+
+func TestFaultSteppingDownLost(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithFaultHook(failAt(FaultOwnerSteppingDown)))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	require.Error(t, upg2.Ready())
+	// zero owners rather than two: the owner stepped down regardless
+	<-upg1.UpgradeComplete()
+	upg1.Stop()
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	require.Nil(t, upg3.PreviousOwner())
+	require.NoError(t, upg3.Ready())
+}
+
+func TestFaultLockFileDeleted(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithFaultHook(func(p FaultPoint) error {
+			if p == FaultLocked {
+				return os.Remove(upg1.coord.idFile())
+			}
+			return nil
+		}))
+	require.True(t, os.IsNotExist(errors.Unwrap(err)) || os.IsNotExist(err), "unexpected error: %v", err)
+}
+
+func TestFaultBecomeOwner(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithFaultHook(failAt(FaultBecomeOwner)))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.True(t, errors.Is(upg1.Ready(), errInjected))
+
+	// the lock was released, so another process can become the owner
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	require.NoError(t, upg2.Ready())
+}
@@ -0,0 +1,172 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FdMismatchError is returned when accessing a file descriptor inherited from
+// the previous owner which isn't what the previous owner advertised it as.
+// Such descriptors are closed as soon as they're received, and the store's
+// accessors return this error for their id until it is removed with Remove.
+type FdMismatchError struct {
+	ID   string
+	Kind string
+	// Reason describes how the descriptor differs from its advertised metadata.
+	Reason string
+}
+
+func (e *FdMismatchError) Error() string {
+	return fmt.Sprintf("inherited fd %v is not the %v it was advertised as: %v", e.ID, e.Kind, e.Reason)
+}
+
+// verifyFd checks the received descriptor of f against its advertised kind,
+// network and address.
+func verifyFd(f *fd) error {
+	fd := f.file.fd
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		return fmt.Errorf("can't stat fd: %w", err)
+	}
+
+	switch f.Kind {
+	case fdKindListener, fdKindConn:
+	case fdKindFile:
+		return nil
+	case fdKindMemfd, fdKindEventfd, fdKindTimerfd, fdKindPidfd, fdKindInotify:
+		return verifySpecialFd(fd, f.Kind)
+	default:
+		return fmt.Errorf("unknown kind %q", f.Kind)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		return errors.New("fd is not a socket")
+	}
+	sockType, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return fmt.Errorf("can't get socket type: %w", err)
+	}
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return fmt.Errorf("can't get socket address: %w", err)
+	}
+
+	wantType, wantFamilies := networkSocket(f.Network)
+	if wantType != 0 && sockType != wantType {
+		return fmt.Errorf("socket type is %v, expected %v for network %q", sockType, wantType, f.Network)
+	}
+	if len(wantFamilies) > 0 && !wantFamilies[sockaddrFamily(sa)] {
+		return fmt.Errorf("socket address %v doesn't belong to network %q", sockaddrString(sa), f.Network)
+	}
+
+	if sockType == unix.SOCK_STREAM || sockType == unix.SOCK_SEQPACKET {
+		accepting, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+		if err != nil {
+			return fmt.Errorf("can't get socket listening state: %w", err)
+		}
+		if f.Kind == fdKindListener && accepting == 0 {
+			return errors.New("socket is not listening")
+		}
+		if f.Kind == fdKindConn && accepting != 0 {
+			return errors.New("socket is listening")
+		}
+	}
+
+	// The address of a conn is the address it was dialed with, which the
+	// socket's local address can't be compared against.
+	if f.Kind == fdKindListener {
+		return verifyListenerAddr(sa, f.Addr)
+	}
+	return nil
+}
+
+// verifyListenerAddr checks that a listening socket is bound to the advertised
+// address, as far as the address determines it: a wildcard or unresolved host,
+// or a port of 0, matches anything.
+func verifyListenerAddr(sa unix.Sockaddr, addr string) error {
+	switch sa := sa.(type) {
+	case *unix.SockaddrUnix:
+		if addr != "" && sa.Name != "" && sa.Name != addr {
+			return fmt.Errorf("socket is bound to %q, not %q", sa.Name, addr)
+		}
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+		_, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port == 0 {
+			return nil
+		}
+		var boundPort int
+		if sa4, ok := sa.(*unix.SockaddrInet4); ok {
+			boundPort = sa4.Port
+		} else {
+			boundPort = sa.(*unix.SockaddrInet6).Port
+		}
+		if boundPort != port {
+			return fmt.Errorf("socket is bound to port %v, not %v", boundPort, port)
+		}
+	}
+	return nil
+}
+
+// networkSocket returns the socket type and address families which sockets of
+// the given network, as understood by the net package, have. It returns zero
+// values for networks it doesn't know about.
+func networkSocket(network string) (int, map[int]bool) {
+	inet := map[int]bool{unix.AF_INET: true, unix.AF_INET6: true}
+	switch network {
+	case "tcp":
+		return unix.SOCK_STREAM, inet
+	case "tcp4":
+		return unix.SOCK_STREAM, map[int]bool{unix.AF_INET: true}
+	case "tcp6":
+		return unix.SOCK_STREAM, map[int]bool{unix.AF_INET6: true}
+	case "udp":
+		return unix.SOCK_DGRAM, inet
+	case "udp4":
+		return unix.SOCK_DGRAM, map[int]bool{unix.AF_INET: true}
+	case "udp6":
+		return unix.SOCK_DGRAM, map[int]bool{unix.AF_INET6: true}
+	case "unix":
+		return unix.SOCK_STREAM, map[int]bool{unix.AF_UNIX: true}
+	case "unixgram":
+		return unix.SOCK_DGRAM, map[int]bool{unix.AF_UNIX: true}
+	case "unixpacket":
+		return unix.SOCK_SEQPACKET, map[int]bool{unix.AF_UNIX: true}
+	}
+	if strings.HasPrefix(network, "ip") {
+		return unix.SOCK_RAW, nil
+	}
+	return 0, nil
+}
+
+func sockaddrFamily(sa unix.Sockaddr) int {
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		return unix.AF_INET
+	case *unix.SockaddrInet6:
+		return unix.AF_INET6
+	case *unix.SockaddrUnix:
+		return unix.AF_UNIX
+	}
+	return -1
+}
+
+func sockaddrString(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrUnix:
+		return "unix:" + sa.Name
+	}
+	return fmt.Sprintf("%T", sa)
+}
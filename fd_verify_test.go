@@ -0,0 +1,91 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestVerifyFd(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	port := ln.Addr().(*net.TCPAddr).Port
+	lnFile, err := dupConn(ln.(*net.TCPListener), "ln")
+	require.NoError(t, err)
+	defer func() { _ = lnFile.Close() }()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+	defer func() { _ = w.Close() }()
+	pipeFile, err := dupFile(w, "pipe")
+	require.NoError(t, err)
+	defer func() { _ = pipeFile.Close() }()
+
+	for _, tc := range []struct {
+		name string
+		fd   *fd
+		ok   bool
+	}{
+		{"listener", &fd{Kind: fdKindListener, Network: "tcp", Addr: ln.Addr().String(), file: lnFile}, true},
+		{"wildcard port", &fd{Kind: fdKindListener, Network: "tcp4", Addr: "localhost:0", file: lnFile}, true},
+		{"wrong port", &fd{Kind: fdKindListener, Network: "tcp", Addr: "127.0.0.1:" + strconv.Itoa(port+1), file: lnFile}, false},
+		{"wrong family", &fd{Kind: fdKindListener, Network: "tcp6", file: lnFile}, false},
+		{"wrong type", &fd{Kind: fdKindListener, Network: "udp", file: lnFile}, false},
+		{"wrong domain", &fd{Kind: fdKindListener, Network: "unix", file: lnFile}, false},
+		{"listener as conn", &fd{Kind: fdKindConn, Network: "tcp", file: lnFile}, false},
+		{"file", &fd{Kind: fdKindFile, file: pipeFile}, true},
+		{"pipe as listener", &fd{Kind: fdKindListener, Network: "tcp", file: pipeFile}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyFd(tc.fd)
+			if tc.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestInheritedFdMismatch(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, upg1.Ready())
+
+	// advertise a listener as a conn
+	upg1.Fds.mu.Lock()
+	upg1.Fds.fds["ln"].Kind = fdKindConn
+	upg1.Fds.mu.Unlock()
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+
+	_, err = upg2.Fds.Conn("ln")
+	var mismatch *FdMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, "ln", mismatch.ID)
+	_, err = upg2.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.True(t, errors.As(err, &mismatch))
+
+	// once removed, the id can be used again
+	require.NoError(t, upg2.Fds.Remove("ln"))
+	ln2, err := upg2.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_ = ln2.Close()
+}
@@ -2,6 +2,7 @@ package tableroll
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"maps"
@@ -36,23 +37,74 @@ var (
 )
 
 // Listener can be shared between processes.
+//
+// Listeners which wrap a Listener, such as ones implementing the proxy
+// protocol or connection limits, can be shared as well if they implement
+// 'Unwrap() net.Listener'. The chain of Unwrap calls is followed until a
+// Listener is found. Only the underlying socket is shared, so a process
+// inheriting it gets a plain listener; use ListenWrapped to apply a wrapper in
+// every process.
 type Listener interface {
 	net.Listener
 	syscall.Conn
 }
 
 // Conn can be shared between processes.
+//
+// Connections which wrap a Conn can be shared as well if they implement
+// 'Unwrap() net.Conn'. The chain of Unwrap calls is followed until a Conn is
+// found. As with listeners, a process inheriting the connection gets a plain
+// one; use DialWrapped to apply a wrapper in every process.
 type Conn interface {
 	net.Conn
 	syscall.Conn
 }
 
+// unwrapListener finds the Listener underlying ln, following the chain of
+// 'Unwrap() net.Listener' methods.
+func unwrapListener(ln net.Listener) (Listener, bool) {
+	for ln != nil {
+		if fdLn, ok := ln.(Listener); ok {
+			return fdLn, true
+		}
+		wrapper, ok := ln.(interface{ Unwrap() net.Listener })
+		if !ok {
+			return nil, false
+		}
+		ln = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// unwrapConn finds the Conn underlying conn, following the chain of
+// 'Unwrap() net.Conn' methods.
+func unwrapConn(conn net.Conn) (Conn, bool) {
+	for conn != nil {
+		if fdConn, ok := conn.(Conn); ok {
+			return fdConn, true
+		}
+		wrapper, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
 type fdKind string
 
 const (
 	fdKindListener fdKind = "listener"
 	fdKindConn     fdKind = "conn"
 	fdKindFile     fdKind = "file"
+
+	// special kinds of files, see fds_special_linux.go
+	fdKindMemfd   fdKind = "memfd"
+	fdKindEventfd fdKind = "eventfd"
+	fdKindTimerfd fdKind = "timerfd"
+	fdKindPidfd   fdKind = "pidfd"
+	fdKindInotify fdKind = "inotify"
 )
 
 // file works around the fact that it's not possible
@@ -103,6 +155,18 @@ type fd struct {
 	// for conns/listeners, stored just for pretty-printing
 	Network string `json:"network,omitempty"`
 	Addr    string `json:"addr,omitempty"`
+
+	// handoff is set for resumable conns, and suspended once it was suspended
+	// for a transfer.
+	handoff   ConnHandoff
+	suspended bool
+	// mismatch is set for received fds which failed verification.
+	mismatch *FdMismatchError
+	// State is the state of a resumable conn, captured when it's transferred.
+	State *ConnState `json:"state,omitempty"`
+	// SocketOptions are the options of a listener, recorded when it's
+	// transferred.
+	SocketOptions *SocketOptions `json:"socketOptions,omitempty"`
 }
 
 func (f *fd) String() string {
@@ -113,6 +177,8 @@ func (f *fd) String() string {
 		return fmt.Sprintf("listener(%v): %v:%v", f.ID, f.Network, f.Addr)
 	case fdKindConn:
 		return fmt.Sprintf("conn(%v): %v:%v", f.ID, f.Network, f.Addr)
+	case fdKindMemfd, fdKindEventfd, fdKindTimerfd, fdKindPidfd, fdKindInotify:
+		return fmt.Sprintf("%v(%v)", f.Kind, f.ID)
 	default:
 		return fmt.Sprintf("unknown: %#v", f)
 	}
@@ -125,6 +191,24 @@ type Fds struct {
 	mu sync.Mutex
 	// NB: Files in these maps may be in blocking mode.
 	fds map[string]*fd
+	// quarantined holds inherited fds which weren't what the previous owner
+	// advertised. Their descriptors have already been closed.
+	quarantined map[string]*FdMismatchError
+
+	// reconcileAddrs enables replacing inherited listeners whose address
+	// changed, see WithListenerAddressReconciliation.
+	reconcileAddrs bool
+	// retired holds replaced listeners until they're closed at Ready.
+	retired          []*fd
+	onListenerChange func(ListenerChange)
+	// backlogSinks are the listeners which accept connections handed off by
+	// the previous owner, by id.
+	backlogSinks map[string]*backlogListener
+	// backlogHandler receives handed off connections without a sink.
+	backlogHandler func(id string, conn net.Conn)
+	// droppedListeners are the ids of inherited listeners closed at Ready,
+	// whose backlog the previous owner hands off.
+	droppedListeners []string
 
 	// locked indicates whether the addition and removal of new listeners is locked.
 	// When true, all mutations will result in an error with the error 'lockedReason'
@@ -147,9 +231,18 @@ func newFds(l *slog.Logger, inherited map[string]*fd) *Fds {
 	if inherited == nil {
 		inherited = make(map[string]*fd)
 	}
+	quarantined := make(map[string]*FdMismatchError)
+	for id, item := range inherited {
+		if item.mismatch != nil {
+			quarantined[id] = item.mismatch
+			delete(inherited, id)
+		}
+	}
 	return &Fds{
-		fds: inherited,
-		l:   l,
+		fds:          inherited,
+		quarantined:  quarantined,
+		backlogSinks: make(map[string]*backlogListener),
+		l:            l,
 	}
 }
 
@@ -173,31 +266,39 @@ func (f *Fds) unlockMutations() {
 // The arguments are passed to net.Listen, and their meaning is described
 // there.
 func (f *Fds) Listen(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	var change *ListenerChange
+	defer func() { f.notifyListenerChange(change) }()
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if cfg == nil {
 		cfg = &net.ListenConfig{}
 	}
 
-	ln, err := f.listenerLocked(id)
+	replaced, err := f.changedListenerLocked(id, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	if ln != nil {
-		f.l.Debug("found existing listener in store", "listenerId", id, "network", network, "addr", addr)
-		return ln, nil
+	if replaced == nil {
+		ln, err := f.listenerLocked(id)
+		if err != nil {
+			return nil, err
+		}
+		if ln != nil {
+			f.l.Debug("found existing listener in store", "listenerId", id, "network", network, "addr", addr)
+			return ln, nil
+		}
 	}
 
 	if f.locked {
 		return nil, f.lockedReason
 	}
 
-	ln, err = cfg.Listen(ctx, network, addr)
+	ln, err := cfg.Listen(ctx, network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("can't create new listener: %w", err)
 	}
 
-	fdLn, ok := ln.(Listener)
+	fdLn, ok := unwrapListener(ln)
 	if !ok {
 		_ = ln.Close()
 		return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
@@ -205,51 +306,100 @@ func (f *Fds) Listen(ctx context.Context, id string, cfg *net.ListenConfig, netw
 
 	err = f.addListenerLocked(id, network, addr, fdLn)
 	if err != nil {
-		_ = fdLn.Close()
+		_ = ln.Close()
 		return nil, err
 	}
+	if replaced != nil {
+		change = f.retireListenerLocked(replaced, network, addr)
+		return f.addBacklogSinkLocked(id, ln), nil
+	}
 
 	return ln, nil
 }
 
+// ListenTLS is like Listen, but returns a listener which serves TLS using the
+// given configuration. Only the underlying socket is shared between
+// processes, so a process inheriting the listener supplies its own TLS
+// configuration, such as a freshly loaded certificate.
+func (f *Fds) ListenTLS(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("a tls config is required")
+	}
+	ln, err := f.Listen(ctx, id, cfg, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
 // ListenWith returns a listener with the given id inherited from the previous
 // owner, or if it doesn't exist creates a new one using the provided function.
 // The listener function should return quickly since it will block any upgrade
 // requests from being serviced.
+// The listener function may return a wrapped listener, as described on
+// Listener. The wrapper is only returned by the process which created the
+// listener; an inherited listener is returned unwrapped. ListenWrapped applies
+// a wrapper in both cases.
 // Note that any unix sockets will have "SetUnlinkOnClose(false)" called on
 // them. Callers may choose to switch them back to 'true' if appropriate.
 // The listener function is compatible with net.Listen.
 func (f *Fds) ListenWith(id, network, addr string, listenerFunc func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	var change *ListenerChange
+	defer func() { f.notifyListenerChange(change) }()
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	ln, err := f.listenerLocked(id)
+	replaced, err := f.changedListenerLocked(id, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	if ln != nil {
-		return ln, nil
+	if replaced == nil {
+		ln, err := f.listenerLocked(id)
+		if err != nil {
+			return nil, err
+		}
+		if ln != nil {
+			return ln, nil
+		}
 	}
 	if f.locked {
 		return nil, f.lockedReason
 	}
 
-	ln, err = listenerFunc(network, addr)
+	ln, err := listenerFunc(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	if _, ok := ln.(Listener); !ok {
+	fdLn, ok := unwrapListener(ln)
+	if !ok {
 		_ = ln.Close()
 		return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
 	}
-	if err := f.addListenerLocked(id, network, addr, ln.(Listener)); err != nil {
+	if err := f.addListenerLocked(id, network, addr, fdLn); err != nil {
 		_ = ln.Close()
 		return nil, err
 	}
+	if replaced != nil {
+		change = f.retireListenerLocked(replaced, network, addr)
+		return f.addBacklogSinkLocked(id, ln), nil
+	}
 	return ln, nil
 }
 
-// Listener returns an inherited listener with the given ID, or nil.
+// ListenWrapped is like ListenWith, but wraps the listener using wrap,
+// whether it was inherited or created by listenerFunc. Wrappers which must
+// apply in every process, such as ones implementing the proxy protocol or
+// connection limits, should be applied this way rather than by listenerFunc.
+func (f *Fds) ListenWrapped(id, network, addr string, listenerFunc func(network, addr string) (net.Listener, error), wrap func(net.Listener) net.Listener) (net.Listener, error) {
+	ln, err := f.ListenWith(id, network, addr, listenerFunc)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(ln), nil
+}
+
+// Listener returns an inherited listener with the given ID, or nil. The
+// listener isn't wrapped, even if the process which created it wrapped it.
 //
 // It is the caller's responsibility to close the returned listener once
 // connections should be drained.
@@ -262,6 +412,9 @@ func (f *Fds) Listener(id string) (net.Listener, error) {
 }
 
 func (f *Fds) listenerLocked(id string) (net.Listener, error) {
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
 	file, ok := f.fds[id]
 	if !ok || file.file == nil {
 		return nil, nil
@@ -292,6 +445,9 @@ func (f *Fds) addListenerLocked(id, addr, network string, ln Listener) error {
 // net.Dial). If an inherited connection with that id exists, it will be
 // returned. Otherwise, the provided function will be called and the resulting
 // connection stored with that id and returned.
+// The function may return a wrapped connection, as described on Conn. The
+// wrapper is only returned by the process which dialed; an inherited connection
+// is returned unwrapped. DialWrapped applies a wrapper in both cases.
 func (f *Fds) DialWith(id, network, address string, dialFn func(network, address string) (net.Conn, error)) (net.Conn, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -311,7 +467,7 @@ func (f *Fds) DialWith(id, network, address string, dialFn func(network, address
 	if err != nil {
 		return nil, err
 	}
-	fdConn, ok := newConn.(Conn)
+	fdConn, ok := unwrapConn(newConn)
 	if !ok {
 		_ = newConn.Close()
 		return nil, fmt.Errorf("%T doesn't implement tableroll.Conn", newConn)
@@ -324,7 +480,18 @@ func (f *Fds) DialWith(id, network, address string, dialFn func(network, address
 	return newConn, nil
 }
 
-// Conn returns an inherited connection or nil.
+// DialWrapped is like DialWith, but wraps the connection using wrap, whether
+// it was inherited or created by dialFn.
+func (f *Fds) DialWrapped(id, network, address string, dialFn func(network, address string) (net.Conn, error), wrap func(net.Conn) net.Conn) (net.Conn, error) {
+	conn, err := f.DialWith(id, network, address, dialFn)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(conn), nil
+}
+
+// Conn returns an inherited connection or nil. The connection isn't wrapped,
+// even if the process which dialed it wrapped it.
 //
 // It is the caller's responsibility to close the returned Conn at the
 // appropriate time, typically when the Upgrader indicates draining and exiting
@@ -336,6 +503,9 @@ func (f *Fds) Conn(id string) (net.Conn, error) {
 }
 
 func (f *Fds) connLocked(id string) (net.Conn, error) {
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
 	file, ok := f.fds[id]
 	if !ok || file.file == nil {
 		return nil, nil
@@ -425,6 +595,10 @@ func (f *Fds) Remove(id string) error {
 		return f.lockedReason
 	}
 
+	if _, ok := f.quarantined[id]; ok {
+		delete(f.quarantined, id)
+		return nil
+	}
 	item, ok := f.fds[id]
 	if !ok {
 		return fmt.Errorf("no element in map with id %v", id)
@@ -436,7 +610,69 @@ func (f *Fds) Remove(id string) error {
 	return nil
 }
 
+// specialLocked returns a copy of an inherited special file of the given
+// kind, after checking that the descriptor is what the previous owner claimed
+// it is.
+func (f *Fds) specialLocked(id string, kind fdKind) (*os.File, error) {
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
+	item, ok := f.fds[id]
+	if !ok || item.file == nil {
+		return nil, nil
+	}
+	if item.Kind != kind {
+		return nil, fmt.Errorf("fd %v is a %v, not a %v", id, item.Kind, kind)
+	}
+	if err := verifySpecialFd(item.file.fd, kind); err != nil {
+		return nil, &FdMismatchError{ID: id, Kind: string(kind), Reason: err.Error()}
+	}
+	dup, err := dupFd(item.file.fd, item.String())
+	if err != nil {
+		return nil, err
+	}
+	item.used = true
+	return dup.File, nil
+}
+
+// openSpecial returns a copy of an inherited special file of the given kind,
+// or creates and stores a new one using the create function.
+func (f *Fds) openSpecial(id string, kind fdKind, create func() (int, error)) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := f.specialLocked(id, kind)
+	if err != nil || fi != nil {
+		return fi, err
+	}
+	if f.locked {
+		return nil, f.lockedReason
+	}
+
+	rawFd, err := create()
+	if err != nil {
+		return nil, fmt.Errorf("can't create %v: %w", kind, err)
+	}
+	newFd := &fd{
+		used: true,
+		ID:   id,
+		Kind: kind,
+	}
+	newFi := os.NewFile(uintptr(rawFd), newFd.String())
+	dup, err := dupFd(uintptr(rawFd), newFd.String())
+	if err != nil {
+		_ = newFi.Close()
+		return nil, err
+	}
+	newFd.file = dup
+	f.fds[id] = newFd
+	return newFi, nil
+}
+
 func (f *Fds) fileLocked(id string) (*os.File, error) {
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
 	file, ok := f.fds[id]
 	if !ok || file.file == nil {
 		return nil, nil
@@ -451,6 +687,15 @@ func (f *Fds) fileLocked(id string) (*os.File, error) {
 	return dup.File, nil
 }
 
+// quarantinedLocked returns the reason the inherited fd with the given id was
+// quarantined, if it was.
+func (f *Fds) quarantinedLocked(id string) error {
+	if mismatch, ok := f.quarantined[id]; ok {
+		return mismatch
+	}
+	return nil
+}
+
 func (f *Fds) copy() map[string]*fd {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -475,11 +720,31 @@ func (f *Fds) closeUnused() error {
 				errs = append(errs, fmt.Errorf("error closing %v: %w", name, err))
 			}
 			delete(f.fds, name)
+			if fd.Kind == fdKindListener {
+				f.droppedListeners = append(f.droppedListeners, name)
+			}
 		}
 	}
 	return errors.Join(errs...)
 }
 
+// closeAll closes and forgets every file descriptor in the store.
+func (f *Fds) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeRetiredLocked()
+
+	for name, fd := range f.fds {
+		if fd.file != nil {
+			if err := fd.file.Close(); err != nil {
+				f.l.Warn("error closing fd", "id", name, "err", err)
+			}
+		}
+		delete(f.fds, name)
+	}
+}
+
 func dupConn(conn syscall.Conn, name string) (*file, error) {
 	// Use SyscallConn instead of File to avoid making the original
 	// fd non-blocking.
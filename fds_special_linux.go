@@ -0,0 +1,128 @@
+//go:build linux
+
+package tableroll
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenMemfd retrieves the given memfd from the store, and if it's not present
+// creates it with memfd_create(2).
+// Memory written to a memfd is shared between the processes taking part in
+// an upgrade, so it survives the upgrade.
+func (f *Fds) OpenMemfd(id string, name string, flags int) (*os.File, error) {
+	return f.openSpecial(id, fdKindMemfd, func() (int, error) {
+		return unix.MemfdCreate(name, flags|unix.MFD_CLOEXEC)
+	})
+}
+
+// Memfd returns an inherited memfd or nil.
+// It returns an error if the inherited descriptor is not a memfd.
+func (f *Fds) Memfd(id string) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.specialLocked(id, fdKindMemfd)
+}
+
+// OpenEventfd retrieves the given eventfd from the store, and if it's not
+// present creates it with eventfd(2).
+func (f *Fds) OpenEventfd(id string, initval uint, flags int) (*os.File, error) {
+	return f.openSpecial(id, fdKindEventfd, func() (int, error) {
+		return unix.Eventfd(initval, flags|unix.EFD_CLOEXEC)
+	})
+}
+
+// Eventfd returns an inherited eventfd or nil.
+// It returns an error if the inherited descriptor is not an eventfd.
+func (f *Fds) Eventfd(id string) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.specialLocked(id, fdKindEventfd)
+}
+
+// OpenTimerfd retrieves the given timerfd from the store, and if it's not
+// present creates it with timerfd_create(2).
+func (f *Fds) OpenTimerfd(id string, clockid int, flags int) (*os.File, error) {
+	return f.openSpecial(id, fdKindTimerfd, func() (int, error) {
+		return unix.TimerfdCreate(clockid, flags|unix.TFD_CLOEXEC)
+	})
+}
+
+// Timerfd returns an inherited timerfd or nil.
+// It returns an error if the inherited descriptor is not a timerfd.
+func (f *Fds) Timerfd(id string) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.specialLocked(id, fdKindTimerfd)
+}
+
+// OpenPidfd retrieves the given pidfd from the store, and if it's not present
+// creates one referring to pid with pidfd_open(2).
+// A pidfd keeps referring to the same process across an upgrade, even if pid
+// is reused.
+func (f *Fds) OpenPidfd(id string, pid int, flags int) (*os.File, error) {
+	return f.openSpecial(id, fdKindPidfd, func() (int, error) {
+		// pidfds are always close-on-exec
+		return unix.PidfdOpen(pid, flags)
+	})
+}
+
+// Pidfd returns an inherited pidfd or nil.
+// It returns an error if the inherited descriptor is not a pidfd.
+func (f *Fds) Pidfd(id string) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.specialLocked(id, fdKindPidfd)
+}
+
+// OpenInotify retrieves the given inotify instance from the store, and if
+// it's not present creates one with inotify_init1(2).
+// Watches added to the instance, and events not yet read from it, are kept
+// across an upgrade.
+func (f *Fds) OpenInotify(id string, flags int) (*os.File, error) {
+	return f.openSpecial(id, fdKindInotify, func() (int, error) {
+		return unix.InotifyInit1(flags | unix.IN_CLOEXEC)
+	})
+}
+
+// Inotify returns an inherited inotify instance or nil.
+// It returns an error if the inherited descriptor is not an inotify instance.
+func (f *Fds) Inotify(id string) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.specialLocked(id, fdKindInotify)
+}
+
+// verifySpecialFd checks that fd is of the given kind, based on the link the
+// kernel exposes for it in /proc.
+func verifySpecialFd(fd uintptr, kind fdKind) error {
+	target, err := os.Readlink("/proc/self/fd/" + strconv.FormatUint(uint64(fd), 10))
+	if err != nil {
+		return fmt.Errorf("can't inspect fd: %w", err)
+	}
+	var ok bool
+	switch kind {
+	case fdKindMemfd:
+		ok = strings.HasPrefix(target, "/memfd:")
+	case fdKindEventfd:
+		ok = target == "anon_inode:[eventfd]"
+	case fdKindTimerfd:
+		ok = target == "anon_inode:[timerfd]"
+	case fdKindPidfd:
+		// kernels with pidfs name pidfds "pidfd:[inode]"
+		ok = target == "anon_inode:[pidfd]" || strings.HasPrefix(target, "pidfd:")
+	case fdKindInotify:
+		ok = target == "anon_inode:inotify"
+	default:
+		return fmt.Errorf("unknown kind %v", kind)
+	}
+	if !ok {
+		return fmt.Errorf("fd refers to %q", target)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package tableroll
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFdsMemfd(t *testing.T) {
+	parent := newFds(l, nil)
+	mem, err := parent.OpenMemfd("mem", "state", 0)
+	require.NoError(t, err)
+	_, err = mem.Write([]byte("shared"))
+	require.NoError(t, err)
+	_ = mem.Close()
+
+	child := newFds(l, parent.copy())
+	mem, err = child.Memfd("mem")
+	require.NoError(t, err)
+	require.NotNil(t, mem)
+	defer func() { _ = mem.Close() }()
+	data := make([]byte, len("shared"))
+	_, err = mem.ReadAt(data, 0)
+	require.NoError(t, err)
+	require.Equal(t, "shared", string(data))
+
+	// asking for the wrong kind is an error
+	_, err = child.Eventfd("mem")
+	require.Error(t, err)
+	// unknown ids are nil, like other accessors
+	mem, err = child.Memfd("missing")
+	require.NoError(t, err)
+	require.Nil(t, mem)
+}
+
+func TestFdsSpecialKinds(t *testing.T) {
+	parent := newFds(l, nil)
+	ev, err := parent.OpenEventfd("ev", 0, 0)
+	require.NoError(t, err)
+	_, err = ev.Write(binary.NativeEndian.AppendUint64(nil, 3))
+	require.NoError(t, err)
+	_ = ev.Close()
+	tfd, err := parent.OpenTimerfd("timer", unix.CLOCK_MONOTONIC, 0)
+	require.NoError(t, err)
+	_ = tfd.Close()
+	in, err := parent.OpenInotify("inotify", 0)
+	require.NoError(t, err)
+	_ = in.Close()
+	pidfd, err := parent.OpenPidfd("pid", os.Getpid(), 0)
+	if err == nil {
+		_ = pidfd.Close()
+	}
+
+	child := newFds(l, parent.copy())
+	ev, err = child.Eventfd("ev")
+	require.NoError(t, err)
+	defer func() { _ = ev.Close() }()
+	counter := make([]byte, 8)
+	_, err = ev.Read(counter)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), binary.NativeEndian.Uint64(counter))
+
+	tfd, err = child.Timerfd("timer")
+	require.NoError(t, err)
+	require.NotNil(t, tfd)
+	_ = tfd.Close()
+	in, err = child.Inotify("inotify")
+	require.NoError(t, err)
+	require.NotNil(t, in)
+	_ = in.Close()
+	if pidfd != nil {
+		pidfd, err = child.Pidfd("pid")
+		require.NoError(t, err)
+		require.NotNil(t, pidfd)
+		_ = pidfd.Close()
+	}
+}
+
+func TestFdsSpecialMismatch(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+	defer func() { _ = w.Close() }()
+
+	// a sender claiming a pipe is an eventfd
+	parent := newFds(l, nil)
+	dup, err := dupFile(w, "ev")
+	require.NoError(t, err)
+	parent.fds["ev"] = &fd{ID: "ev", Kind: fdKindEventfd, file: dup}
+
+	child := newFds(l, parent.copy())
+	_, err = child.Eventfd("ev")
+	var mismatch *FdMismatchError
+	require.True(t, errors.As(err, &mismatch))
+}
@@ -0,0 +1,64 @@
+//go:build !linux
+
+package tableroll
+
+import (
+	"errors"
+	"os"
+)
+
+var errSpecialUnsupported = errors.New("special file descriptors are only supported on linux")
+
+// OpenMemfd is only supported on linux.
+func (f *Fds) OpenMemfd(id string, name string, flags int) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// Memfd is only supported on linux.
+func (f *Fds) Memfd(id string) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// OpenEventfd is only supported on linux.
+func (f *Fds) OpenEventfd(id string, initval uint, flags int) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// Eventfd is only supported on linux.
+func (f *Fds) Eventfd(id string) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// OpenTimerfd is only supported on linux.
+func (f *Fds) OpenTimerfd(id string, clockid int, flags int) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// Timerfd is only supported on linux.
+func (f *Fds) Timerfd(id string) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// OpenPidfd is only supported on linux.
+func (f *Fds) OpenPidfd(id string, pid int, flags int) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// Pidfd is only supported on linux.
+func (f *Fds) Pidfd(id string) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// OpenInotify is only supported on linux.
+func (f *Fds) OpenInotify(id string, flags int) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+// Inotify is only supported on linux.
+func (f *Fds) Inotify(id string) (*os.File, error) {
+	return nil, errSpecialUnsupported
+}
+
+func verifySpecialFd(fd uintptr, kind fdKind) error {
+	return errSpecialUnsupported
+}
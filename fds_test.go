@@ -2,10 +2,19 @@ package tableroll
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -154,6 +163,132 @@ func TestFdsFile(t *testing.T) {
 	_ = file.Close()
 }
 
+func TestFdsListenTLS(t *testing.T) {
+	ctx := context.Background()
+
+	parent := newFds(l, nil)
+	ln, err := parent.ListenTLS(ctx, "tls", nil, "tcp", "127.0.0.1:0", selfSignedTLSConfig(t, "parent"))
+	require.NoError(t, err)
+	_ = ln.Close()
+
+	// the inheriting process serves the same socket with a new certificate
+	child := newFds(l, parent.copy())
+	ln, err = child.ListenTLS(ctx, "tls", nil, "tcp", "127.0.0.1:0", selfSignedTLSConfig(t, "child"))
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		_ = conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.Equal(t, "child", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func selfSignedTLSConfig(t *testing.T, commonName string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+type wrappedListener struct{ net.Listener }
+
+func (w wrappedListener) Unwrap() net.Listener { return w.Listener }
+
+type wrappedConn struct{ net.Conn }
+
+func (w wrappedConn) Unwrap() net.Conn { return w.Conn }
+
+func TestFdsUnwrap(t *testing.T) {
+	parent := newFds(l, nil)
+	var wrapped net.Listener
+	ln, err := parent.ListenWith("ln", "tcp", "127.0.0.1:0", func(network, addr string) (net.Listener, error) {
+		inner, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// wrap twice to check the chain is followed
+		wrapped = wrappedListener{wrappedListener{inner}}
+		return wrapped, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, wrapped, ln)
+	_ = ln.Close()
+
+	conn, err := parent.DialWith("conn", "unixgram", "", func(_, _ string) (net.Conn, error) {
+		inner, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		return wrappedConn{inner}, nil
+	})
+	require.NoError(t, err)
+	require.IsType(t, wrappedConn{}, conn)
+	_ = conn.Close()
+
+	_, err = parent.ListenWith("opaque", "tcp", "127.0.0.1:0", func(network, addr string) (net.Listener, error) {
+		inner, err := net.Listen(network, addr)
+		return struct{ net.Listener }{inner}, err
+	})
+	require.Error(t, err)
+
+	wrapLn := func(ln net.Listener) net.Listener { return wrappedListener{ln} }
+	ln, err = parent.ListenWrapped("wrapped", "tcp", "127.0.0.1:0", net.Listen, wrapLn)
+	require.NoError(t, err)
+	require.IsType(t, wrappedListener{}, ln)
+	_ = ln.Close()
+	wrapConn := func(conn net.Conn) net.Conn { return wrappedConn{conn} }
+	conn, err = parent.DialWrapped("wrappedConn", "unixgram", "", func(_, _ string) (net.Conn, error) {
+		return net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	}, wrapConn)
+	require.NoError(t, err)
+	require.IsType(t, wrappedConn{}, conn)
+	_ = conn.Close()
+
+	// inherited fds are returned unwrapped, unless they're wrapped again
+	child := newFds(l, parent.copy())
+	ln, err = child.Listener("ln")
+	require.NoError(t, err)
+	require.IsType(t, &net.TCPListener{}, ln)
+	_ = ln.Close()
+	ln, err = child.ListenWith("ln", "tcp", "127.0.0.1:0", net.Listen)
+	require.NoError(t, err)
+	require.IsType(t, &net.TCPListener{}, ln)
+	_ = ln.Close()
+	ln, err = child.ListenWrapped("wrapped", "tcp", "127.0.0.1:0", net.Listen, wrapLn)
+	require.NoError(t, err)
+	require.IsType(t, wrappedListener{}, ln)
+	require.IsType(t, &net.TCPListener{}, ln.(wrappedListener).Listener)
+	_ = ln.Close()
+	conn, err = child.Conn("conn")
+	require.NoError(t, err)
+	require.IsType(t, &net.UnixConn{}, conn)
+	_ = conn.Close()
+	conn, err = child.DialWrapped("wrappedConn", "unixgram", "", func(_, _ string) (net.Conn, error) {
+		return nil, errors.New("should have been inherited")
+	}, wrapConn)
+	require.NoError(t, err)
+	require.IsType(t, wrappedConn{}, conn)
+	require.IsType(t, &net.UnixConn{}, conn.(wrappedConn).Conn)
+	_ = conn.Close()
+}
+
 func TestFdsLock(t *testing.T) {
 	fds := newFds(l, nil)
 
@@ -0,0 +1,67 @@
+package tableroll
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// groupIDFilePrefix prefixes the name of a group to name the file recording
+// its owner, and locked while taking over from it.
+const groupIDFilePrefix = "pid."
+
+// ErrInvalidGroup is returned by New for a group name which can't be used, see
+// WithGroup.
+var ErrInvalidGroup = errors.New("invalid group name")
+
+// WithGroup places the upgrader in the named group of its coordination
+// directory. Each group is an independent upgrade chain with its own owner, so
+// that a single directory can host several instances of a program, such as one
+// per shard. A group's owner is recorded in the "pid.<name>" file, and the
+// upgrade sockets of its processes are in the "<name>" subdirectory.
+//
+// The name must be usable as a file name, must neither start with a dot nor
+// end with ".sock", and must neither be "pid" nor start with "pid.", which
+// would collide with the owner files. Upgraders without a group, or with an
+// empty one, form the default group, which is compatible with versions of
+// tableroll without groups.
+func WithGroup(name string) Option {
+	return func(u *Upgrader) {
+		u.group = name
+	}
+}
+
+func validateGroup(name string) error {
+	if name == "" {
+		return nil
+	}
+	if strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".sock") {
+		return errors.Wrapf(ErrInvalidGroup, "%q", name)
+	}
+	// the group's socket directory would be the default owner file, or
+	// another group's
+	if name == "pid" || strings.HasPrefix(name, groupIDFilePrefix) {
+		return errors.Wrapf(ErrInvalidGroup, "%q", name)
+	}
+	return nil
+}
+
+// ListGroups returns the names of the groups which have been used in the given
+// coordination directory, sorted. The default group isn't included.
+func ListGroups(coordinationDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(coordinationDir, groupIDFilePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimPrefix(filepath.Base(path), groupIDFilePrefix)
+		if validateGroup(name) == nil {
+			groups = append(groups, name)
+		}
+	}
+	slices.Sort(groups)
+	return groups, nil
+}
@@ -0,0 +1,93 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestGroups(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	newInGroup := func(group, id string) *Upgrader {
+		upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, id, WithLogger(l.With("group", group, "pid", id)), WithGroup(group))
+		require.NoError(t, err)
+		t.Cleanup(upg.Stop)
+		return upg
+	}
+
+	// the default group and two named groups each get an owner
+	def := newInGroup("", "1")
+	require.NoError(t, def.Ready())
+	a1 := newInGroup("a", "1")
+	ln, err := a1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, a1.Ready())
+	b1 := newInGroup("b", "1")
+	require.NoError(t, b1.Ready())
+	require.Nil(t, a1.PreviousOwner())
+	require.Nil(t, b1.PreviousOwner())
+
+	for _, path := range []string{"pid", "1.sock", "pid.a", "a/1.sock", "pid.b", "b/1.sock"} {
+		_, err := os.Stat(filepath.Join(coordDir, path))
+		require.NoError(t, err, path)
+	}
+	groups, err := ListGroups(coordDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, groups)
+
+	// an upgrade in a group takes over from that group's owner only
+	a2 := newInGroup("a", "2")
+	inherited, err := a2.Fds.Listener("ln")
+	require.NoError(t, err)
+	require.NotNil(t, inherited)
+	defer func() { _ = inherited.Close() }()
+	require.NoError(t, a2.Ready())
+	<-a1.UpgradeComplete()
+	require.Equal(t, "1", a2.PreviousOwner().ID)
+
+	status, err := QueryStatus(ctx, coordDir, InGroup("a"))
+	require.NoError(t, err)
+	require.Equal(t, "2", status.ID)
+	require.Equal(t, 1, status.Fds)
+	for _, upg := range []*Upgrader{def, b1} {
+		select {
+		case <-upg.UpgradeComplete():
+			t.Fatal("an owner of another group stepped down")
+		default:
+		}
+	}
+
+	dirStatus, err := InspectDir(ctx, coordDir, InGroup("b"))
+	require.NoError(t, err)
+	require.Equal(t, &DirStatus{OwnerID: "1", OwnerListening: true}, dirStatus)
+	dirStatus, err = InspectDir(ctx, coordDir)
+	require.NoError(t, err)
+	require.Equal(t, &DirStatus{OwnerID: "1", OwnerListening: true}, dirStatus)
+}
+
+func TestInvalidGroup(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+	// "pid.a" would otherwise be the owner file of this group
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithGroup("a"))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+	for _, name := range []string{"../a", "a/b", ".hidden", "a.sock", "pid", "pid.a"} {
+		_, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithGroup(name))
+		require.True(t, errors.Is(err, ErrInvalidGroup), "%q: unexpected error: %v", name, err)
+		_, err = InspectDir(ctx, coordDir, InGroup(name))
+		require.True(t, errors.Is(err, ErrInvalidGroup), "%q: unexpected error: %v", name, err)
+	}
+	groups, err := ListGroups(coordDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, groups)
+}
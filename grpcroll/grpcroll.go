@@ -0,0 +1,125 @@
+// Package grpcroll runs a gRPC server on a listener managed by a
+// tableroll.Upgrader, and gracefully stops it once another process has taken
+// over.
+package grpcroll
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+// DefaultStopTimeout is how long a Server waits for in-flight RPCs to finish
+// before forcefully stopping the gRPC server.
+const DefaultStopTimeout time.Duration = 30 * time.Second
+
+// GRPCServer is the subset of *grpc.Server's methods used by Server.
+// It is satisfied by *grpc.Server, which spares this package from depending on
+// grpc itself.
+type GRPCServer interface {
+	Serve(net.Listener) error
+	GracefulStop()
+	Stop()
+}
+
+// Server serves a gRPC server on a listener obtained from a
+// tableroll.Upgrader's Fds.
+type Server struct {
+	// Upgrader provides the listener and signals when to stop.
+	Upgrader *tableroll.Upgrader
+	// GRPC is the server to run, typically a *grpc.Server.
+	GRPC GRPCServer
+
+	// ID identifies the listener in the Upgrader's Fds.
+	ID string
+	// Network and Addr are passed to Fds.Listen. Network defaults to "tcp".
+	Network string
+	Addr    string
+	// ListenConfig is passed to Fds.Listen.
+	ListenConfig *net.ListenConfig
+
+	// StopTimeout bounds how long in-flight RPCs may take once the upgrade
+	// completed. If 0, DefaultStopTimeout is used.
+	StopTimeout time.Duration
+	// SkipReady disables calling Upgrader.Ready once the server is serving.
+	// Processes which serve several servers, or manage other fds, should set it
+	// and call Ready themselves once everything is set up.
+	SkipReady bool
+}
+
+// ListenAndServe obtains the listener, serves on it, marks the upgrader as
+// ready, and waits for the upgrade to complete. It then calls GracefulStop,
+// which sends GOAWAY so that clients reconnect to the new owner, and calls
+// Stop if in-flight RPCs haven't finished by the stop timeout.
+// Cancelling ctx stops the server the same way.
+// It returns nil if the server stopped gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	ln, err := s.Upgrader.Fds.Listen(ctx, s.ID, s.ListenConfig, network, s.Addr)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.GRPC.Serve(ln)
+	}()
+
+	if !s.SkipReady {
+		if err := s.Upgrader.Ready(); err != nil {
+			s.GRPC.Stop()
+			return err
+		}
+	}
+
+	select {
+	case <-s.Upgrader.UpgradeComplete():
+	case <-ctx.Done():
+	case err := <-serveErr:
+		return err
+	}
+
+	timeout := s.StopTimeout
+	if timeout == 0 {
+		timeout = DefaultStopTimeout
+	}
+	drainer := tableroll.NewDrainer(s.Upgrader, tableroll.WithDrainTimeout(timeout), tableroll.WithDefaultPhaseTimeout(timeout))
+	drainer.Add(tableroll.DrainStep{
+		Name: s.ID,
+		Drain: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				s.GRPC.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+		Force: func() error {
+			s.GRPC.Stop()
+			return nil
+		},
+	})
+	report := drainer.Drain()
+
+	// grpc's Serve returns nil once stopped
+	if err := <-serveErr; err != nil {
+		return err
+	}
+	for _, step := range report.Steps {
+		if step.Err != nil {
+			return fmt.Errorf("could not stop %s gracefully: %w", step.Name, step.Err)
+		}
+	}
+	return nil
+}
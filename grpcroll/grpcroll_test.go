@@ -0,0 +1,148 @@
+package grpcroll
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+// fakeServer imitates a *grpc.Server which replies to each connection with
+// its id, optionally hanging until it is forcefully stopped.
+type fakeServer struct {
+	id   string
+	hang bool
+
+	mu              sync.Mutex
+	ln              net.Listener
+	conns           sync.WaitGroup
+	stopOnce        sync.Once
+	stop            chan struct{}
+	gracefulStopped bool
+	stopped         bool
+}
+
+func newFakeServer(id string, hang bool) *fakeServer {
+	return &fakeServer{id: id, hang: hang, stop: make(chan struct{})}
+}
+
+func (f *fakeServer) Serve(ln net.Listener) error {
+	f.mu.Lock()
+	f.ln = ln
+	f.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil
+		}
+		f.conns.Add(1)
+		go func() {
+			defer f.conns.Done()
+			defer func() { _ = conn.Close() }()
+			_, _ = conn.Write([]byte(f.id))
+			if f.hang {
+				<-f.stop
+			}
+		}()
+	}
+}
+
+func (f *fakeServer) GracefulStop() {
+	f.mu.Lock()
+	f.gracefulStopped = true
+	_ = f.ln.Close()
+	f.mu.Unlock()
+	f.conns.Wait()
+}
+
+func (f *fakeServer) Stop() {
+	f.mu.Lock()
+	f.stopped = true
+	_ = f.ln.Close()
+	f.mu.Unlock()
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+func TestServerHandoff(t *testing.T) {
+	ctx := t.Context()
+	coordDir := t.TempDir()
+	addr := freeAddr(t)
+
+	start := func(id string) (*tableroll.Upgrader, *fakeServer, chan error) {
+		upg, err := tableroll.New(ctx, coordDir, id)
+		require.NoError(t, err)
+		fake := newFakeServer(id, false)
+		srv := &Server{Upgrader: upg, GRPC: fake, ID: "grpc", Addr: addr}
+		done := make(chan error, 1)
+		go func() { done <- srv.ListenAndServe(ctx) }()
+		return upg, fake, done
+	}
+
+	upg1, fake1, done1 := start("1")
+	defer upg1.Stop()
+	require.Eventually(t, func() bool { return read(addr) == "1" }, 5*time.Second, 10*time.Millisecond)
+
+	upg2, _, done2 := start("2")
+	defer upg2.Stop()
+	require.NoError(t, <-done1)
+	require.True(t, fake1.gracefulStopped)
+	require.False(t, fake1.stopped)
+	require.Equal(t, "2", read(addr))
+
+	upg2.Stop()
+	require.NoError(t, <-done2)
+}
+
+func TestServerForcedStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	upg, err := tableroll.New(ctx, t.TempDir(), "1")
+	require.NoError(t, err)
+	defer upg.Stop()
+	fake := newFakeServer("1", true)
+	addr := freeAddr(t)
+	srv := &Server{Upgrader: upg, GRPC: fake, ID: "grpc", Addr: addr, StopTimeout: 20 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(ctx) }()
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", addr)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer func() { _ = conn.Close() }()
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	// the rpc on conn hangs, so stopping has to be forced
+	cancel()
+	err = <-done
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+	require.True(t, fake.stopped)
+}
+
+func read(addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = conn.Close() }()
+	data, _ := io.ReadAll(conn)
+	return string(data)
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
@@ -0,0 +1,103 @@
+// Package httproll runs an http.Server on a listener managed by a
+// tableroll.Upgrader, and gracefully shuts it down once another process has
+// taken over.
+package httproll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+// DefaultShutdownTimeout is how long a Server waits for in-flight requests
+// to finish before closing their connections.
+const DefaultShutdownTimeout time.Duration = 30 * time.Second
+
+// Server serves an http.Server on a listener obtained from a
+// tableroll.Upgrader's Fds.
+type Server struct {
+	// Upgrader provides the listener and signals when to shut down.
+	Upgrader *tableroll.Upgrader
+	// HTTP is the server to run.
+	HTTP *http.Server
+
+	// ID identifies the listener in the Upgrader's Fds.
+	ID string
+	// Network and Addr are passed to Fds.Listen. Network defaults to "tcp",
+	// and Addr defaults to HTTP.Addr.
+	Network string
+	Addr    string
+	// ListenConfig is passed to Fds.Listen.
+	ListenConfig *net.ListenConfig
+
+	// ShutdownTimeout bounds how long in-flight requests may take once the
+	// upgrade completed. If 0, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+	// SkipReady disables calling Upgrader.Ready once the server is serving.
+	// Processes which serve several servers, or manage other fds, should set it
+	// and call Ready themselves once everything is set up.
+	SkipReady bool
+}
+
+// ListenAndServe obtains the listener, serves on it, marks the upgrader as
+// ready, and waits for the upgrade to complete. It then disables keep-alives
+// and shuts the server down, closing any connections still active after the
+// shutdown timeout.
+// Cancelling ctx shuts the server down the same way.
+// It returns nil if the server shut down gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = s.HTTP.Addr
+	}
+	ln, err := s.Upgrader.Fds.Listen(ctx, s.ID, s.ListenConfig, network, addr)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.HTTP.Serve(ln)
+	}()
+
+	if !s.SkipReady {
+		if err := s.Upgrader.Ready(); err != nil {
+			_ = s.HTTP.Close()
+			return err
+		}
+	}
+
+	select {
+	case <-s.Upgrader.UpgradeComplete():
+	case <-ctx.Done():
+	case err := <-serveErr:
+		return err
+	}
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	drainer := tableroll.NewDrainer(s.Upgrader, tableroll.WithDrainTimeout(timeout), tableroll.WithDefaultPhaseTimeout(timeout))
+	drainer.AddHTTPServer(s.ID, 0, s.HTTP)
+	report := drainer.Drain()
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	for _, step := range report.Steps {
+		if step.Err != nil {
+			return fmt.Errorf("could not shut down %s gracefully: %w", step.Name, step.Err)
+		}
+	}
+	return nil
+}
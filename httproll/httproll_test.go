@@ -0,0 +1,70 @@
+package httproll
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+func TestServerHandoff(t *testing.T) {
+	ctx := t.Context()
+	coordDir := t.TempDir()
+
+	addr := freeAddr(t)
+	start := func(id string) (*tableroll.Upgrader, chan error) {
+		upg, err := tableroll.New(ctx, coordDir, id)
+		require.NoError(t, err)
+		srv := &Server{
+			Upgrader: upg,
+			HTTP: &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					_, _ = w.Write([]byte(id))
+				}),
+			},
+			ID:              "http",
+			Addr:            addr,
+			ShutdownTimeout: time.Second,
+		}
+		done := make(chan error, 1)
+		go func() { done <- srv.ListenAndServe(ctx) }()
+		return upg, done
+	}
+
+	upg1, done1 := start("1")
+	defer upg1.Stop()
+	require.Eventually(t, func() bool { return get(t, addr) == "1" }, 5*time.Second, 10*time.Millisecond)
+
+	upg2, done2 := start("2")
+	defer upg2.Stop()
+	require.NoError(t, <-done1)
+	require.Equal(t, "2", get(t, addr))
+
+	upg2.Stop()
+	require.NoError(t, <-done2)
+}
+
+func get(t *testing.T, addr string) string {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
@@ -3,7 +3,7 @@ package proto
 const (
 	// Version is the latest version of the protocol. It is implicitly 0 for
 	// clients that didn't yet have a protocol version
-	Version = 1
+	Version = 3
 
 	// V0NotifyReady is the value sent at the end in the v0 protocol to indicate
 	// readyness
@@ -14,4 +14,21 @@ const (
 
 	// V1MessageSteppingDown is the message the old process sends in the handshake
 	V1MessageSteppingDown = "stepping down"
+
+	// V2StartHello is sent by the new process, after it has received all file
+	// descriptors, to indicate a 'Hello' follows
+	V2StartHello = 0x43
+
+	// QueryAddrPrefix starts the name of the address an admin client binds its
+	// socket to before connecting, which tells the owner to expect a Query
+	// rather than an upgrade.
+	QueryAddrPrefix = "tableroll-query-"
+
+	// QueryStatus asks for the state of the process.
+	QueryStatus = "status"
+	// QueryFds asks for the owner's file descriptors.
+	QueryFds = "fds"
+	// QueryEvents asks the owner to stream its events until the client
+	// disconnects.
+	QueryEvents = "events"
 )
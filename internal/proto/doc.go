@@ -2,7 +2,7 @@
 // tableroll processes at various versions, as well as the functions for
 // reading and writing this data off the wire.
 //
-// Currently, there are two protocol versions: v0 and v1.
+// Currently, there are four protocol versions: v0, v1, v2 and v3.
 // The v1 protocol exists because the v0 protocol allows for a new process to
 // think it had notified the previous owner it was ready, even if the new owner
 // never read that byte.
@@ -33,4 +33,56 @@
 // mode, which is what we want.
 // All other cases should result in O remaining the owner, or the ownership
 // transfer completing successfully.
+//
+// The v2 protocol adds a 'hello' exchange in which both processes introduce
+// themselves, and which lets O inspect, and possibly refuse, the process
+// taking over. It takes place after N has received all file descriptors from
+// an O that advertised v2+, and before N returns control to its caller:
+//
+// N sends 'V2StartHello' to O
+// N sends 'Hello{Version: <N's version>, Process: {...}}' to O
+// O sends 'HelloResponse{Accepted: true|false, Reason: ..., Owner: {...}}' to N
+//
+// Hello carries the highest version N speaks, 'Version' in this package, which
+// may be newer than O's; the version both processes use is only settled by
+// the ready handshake.
+// If O refuses, it closes the connection and remains the owner. Otherwise the
+// v1 ready handshake follows as described above, with N sending the lower of
+// its own version and O's version.
+// Since N only sends a hello to an O which advertised v2+, and O only expects
+// one after advertising v2+, processes at any combination of versions remain
+// able to hand over to each other.
+//
+// The v3 protocol keeps the connection open after a ready handshake in which
+// N sent a version of 3 or more, so that O can hand over connections still
+// queued on listeners N didn't keep, as O stops accepting on them:
+//
+// N sends 'BacklogRequest{IDs: [...]}' to O once it is ready
+// O sends 'BacklogConn{ID: ...}' to N, followed by the connection's fd
+// (repeated for each connection)
+// O closes the connection once it exits
+//
+// Since the connection is only kept open when both processes speak v3, older
+// processes are unaffected.
+//
+// v3 also lets an admin client, A, query a process over its upgrade socket
+// without starting an upgrade. Queries were added after the backlog handoff
+// had introduced v3, and processes speaking v2 don't recognise them, so they
+// are part of v3 rather than v2. A binds its end of the connection to a unix
+// address whose base name starts with 'QueryAddrPrefix', which the process
+// sees as the peer address when accepting, before anything is read:
+//
+// A sends 'Query{Version: <A's version>, Type: ...}'
+// the process sends 'QueryResponse{Version: <its version>, ...}' and closes
+// the connection
+//
+// For a 'QueryEvents' query the process instead sends an 'Event' for each
+// event it emits, until A closes the connection or the process stops or
+// steps down, after which it closes the connection.
+// Queries only read the process' state: they don't lock the owner's file
+// descriptors, and are answered while an upgrade is in progress. The process
+// closes a query connection if A doesn't send its Query within the process'
+// upgrade timeout, or once the process stops.
+// A process at v2 or below treats a query as an upgrade attempt which fails
+// once A sends its Query, and remains the owner.
 package proto
@@ -10,6 +10,19 @@ import (
 	"github.com/pkg/errors"
 )
 
+// MaxFrameSize is the largest length-prefixed json blob, including its version
+// prefix, which is written or read. It bounds what a misbehaving peer can make
+// us allocate.
+const MaxFrameSize = 8 << 20
+
+var (
+	// ErrFrameTooLarge is returned for a json blob larger than MaxFrameSize.
+	ErrFrameTooLarge = errors.New("protocol error: json blob exceeds maximum frame size")
+	// ErrNegativeLength is returned when a peer sends a negative length for a
+	// json blob.
+	ErrNegativeLength = errors.New("protocol error: negative json blob length")
+)
+
 // WriteVersionedJSONBlob writes a JSON blob to the given writer. It expects
 // the blob to be read using 'ReadVersionedJSONBlob'.
 // A version is included via a v0 compatible hack since v0 did not include the
@@ -23,6 +36,9 @@ func WriteVersionedJSONBlob(dst io.Writer, obj any, version uint32) error {
 	if err := json.NewEncoder(&jsonBlob).Encode(obj); err != nil {
 		return err
 	}
+	if jsonBlob.Len() > MaxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "%v bytes", jsonBlob.Len())
+	}
 
 	var jsonBlobLenBuf bytes.Buffer
 	if err := binary.Write(&jsonBlobLenBuf, binary.BigEndian, int32(jsonBlob.Len())); err != nil {
@@ -52,6 +68,12 @@ func ReadVersionedJSONBlob(src io.Reader, obj any) (uint32, error) {
 	if err := binary.Read(src, binary.BigEndian, &jsonLen); err != nil {
 		return 0, errors.Wrap(err, "protocol error: could not read length of json")
 	}
+	if jsonLen < 0 {
+		return 0, errors.Wrapf(ErrNegativeLength, "%v", jsonLen)
+	}
+	if jsonLen > MaxFrameSize {
+		return 0, errors.Wrapf(ErrFrameTooLarge, "%v bytes", jsonLen)
+	}
 
 	// don't decode directly from src, but rather go through a buffer, because
 	// `json.Decode` will attempt to use a buffered reader which can accidentally
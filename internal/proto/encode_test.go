@@ -0,0 +1,83 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lengthPrefixed(length int32, data []byte) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, length)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestReadVersionedJSONBlobLimits(t *testing.T) {
+	var obj any
+	_, err := ReadVersionedJSONBlob(bytes.NewReader(lengthPrefixed(-1, nil)), &obj)
+	if !errors.Is(err, ErrNegativeLength) {
+		t.Errorf("expected ErrNegativeLength, got %v", err)
+	}
+	_, err = ReadVersionedJSONBlob(bytes.NewReader(lengthPrefixed(MaxFrameSize+1, nil)), &obj)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+	// a truncated blob is an error rather than a short read
+	_, err = ReadVersionedJSONBlob(bytes.NewReader(lengthPrefixed(10, []byte("{}"))), &obj)
+	if err == nil {
+		t.Error("expected an error for a truncated blob")
+	}
+	// an overlong version prefix doesn't overflow
+	_, err = ReadVersionedJSONBlob(bytes.NewReader(lengthPrefixed(20, []byte(strings.Repeat("\n", 18)+"{}"))), &obj)
+	if err == nil {
+		t.Error("expected an error for an overlong version prefix")
+	}
+}
+
+func TestWriteJSONBlobTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteJSONBlob(&buf, strings.Repeat("a", MaxFrameSize))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %v bytes of an oversized blob", buf.Len())
+	}
+}
+
+func FuzzReadVersionedJSONBlob(f *testing.F) {
+	for _, v := range []uint32{0, 1, Version} {
+		var buf bytes.Buffer
+		if err := WriteVersionedJSONBlob(&buf, Message{Msg: V1MessageSteppingDown}, v); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add(lengthPrefixed(-1, nil))
+	f.Add(lengthPrefixed(MaxFrameSize+1, nil))
+	f.Add(lengthPrefixed(4, []byte("  {}")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var obj any
+		version, err := ReadVersionedJSONBlob(bytes.NewReader(data), &obj)
+		if err != nil {
+			return
+		}
+		// whatever was read is written back the same way
+		var buf bytes.Buffer
+		if err := WriteVersionedJSONBlob(&buf, obj, version); err != nil {
+			t.Fatalf("can't write back %#v: %v", obj, err)
+		}
+		var again any
+		againVersion, err := ReadVersionedJSONBlob(&buf, &again)
+		if err != nil {
+			t.Fatalf("can't read back %#v: %v", obj, err)
+		}
+		if againVersion != version || !reflect.DeepEqual(obj, again) {
+			t.Fatalf("roundtrip error: (%v, %#v) != (%v, %#v)", version, obj, againVersion, again)
+		}
+	})
+}
@@ -21,8 +21,15 @@ func encodeVersion(version uint32) []byte {
 	return result
 }
 
+// maxVersionLen is the length of the longest encoded version, 2 bits per
+// character.
+const maxVersionLen = 16
+
 // decodeVersion decodes a version from a json-ignorable sequence of whitespace
 func decodeVersion(data []byte) (uint32, error) {
+	if len(data) > maxVersionLen {
+		return 0, fmt.Errorf("version prefix too long: %v characters", len(data))
+	}
 	var version uint32
 	for i := len(data) - 1; i >= 0; i-- {
 		crumb, err := decodeCrumb(data[i])
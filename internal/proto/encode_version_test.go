@@ -41,3 +41,29 @@ func TestQuickcheckVersionEncodeDecode(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func FuzzDecodeVersion(f *testing.F) {
+	for _, v := range []uint32{0, 1, 2, 3, 0xffffffff} {
+		f.Add(encodeVersion(v))
+	}
+	f.Add([]byte("  \t\r\n{"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := decodeVersion(data)
+		if err != nil {
+			return
+		}
+		if len(data) > maxVersionLen {
+			t.Fatalf("decoded a %v character prefix", len(data))
+		}
+		for _, c := range data {
+			if !isJSONIgnorableWhitespace(c) {
+				t.Fatalf("decoded a prefix containing %q", c)
+			}
+		}
+		// trailing zero crumbs aside, the encoding is canonical
+		roundtrip, err := decodeVersion(encodeVersion(v))
+		if err != nil || roundtrip != v {
+			t.Fatalf("roundtrip error: %v != %v (%v)", v, roundtrip, err)
+		}
+	})
+}
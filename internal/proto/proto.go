@@ -1,5 +1,7 @@
 package proto
 
+import "time"
+
 // VersionInformation communicates the protocol version this process supports.
 // Added in v1
 type VersionInformation struct {
@@ -9,3 +11,100 @@ type VersionInformation struct {
 type Message struct {
 	Msg string `json:"msg"`
 }
+
+// Process describes a tableroll process taking part in an upgrade.
+// Added in v2
+type Process struct {
+	ID         string            `json:"id"`
+	AppVersion string            `json:"appVersion,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// Hello introduces a new process to the owner it is taking over from.
+// Added in v2
+type Hello struct {
+	// Version is the highest protocol version the new process speaks.
+	Version int32   `json:"version"`
+	Process Process `json:"process"`
+}
+
+// HelloResponse is the owner's answer to a Hello, which also introduces the
+// owner. If the upgrade is not accepted, Reason explains why.
+// Added in v2
+type HelloResponse struct {
+	Accepted bool    `json:"accepted"`
+	Reason   string  `json:"reason,omitempty"`
+	Owner    Process `json:"owner"`
+}
+
+// BacklogRequest is sent by the new owner once it is ready, and lists the
+// listeners it didn't keep, whose backlog the previous owner should hand off.
+// Added in v3
+type BacklogRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BacklogConn precedes a connection the previous owner accepted from a
+// listener's backlog and hands to the new owner after the ready handshake.
+// Added in v3
+type BacklogConn struct {
+	ID string `json:"id"`
+}
+
+// Query is sent by an admin client, instead of performing an upgrade, to
+// inspect the owner. Query connections are recognized by the address the
+// client binds to, see QueryAddrPrefix.
+// Added in v3
+type Query struct {
+	Version int32  `json:"version"`
+	Type    string `json:"type"`
+}
+
+// FdInfo describes a file descriptor held by the owner.
+// Added in v3
+type FdInfo struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Network string `json:"network,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+}
+
+// Status describes the process answering a QueryStatus.
+// Added in v3
+type Status struct {
+	Process Process `json:"process"`
+	// State is the upgrader's state, such as "owner" or "draining".
+	State string `json:"state"`
+	// Fds is the number of file descriptors held, if the process is the owner.
+	Fds               int  `json:"fds"`
+	UpgradeInProgress bool `json:"upgradeInProgress"`
+}
+
+// QueryResponse answers a Query, other than a QueryEvents one.
+// Added in v3
+type QueryResponse struct {
+	Version int32    `json:"version"`
+	Error   string   `json:"error,omitempty"`
+	Fds     []FdInfo `json:"fds,omitempty"`
+	Status  *Status  `json:"status,omitempty"`
+}
+
+// ListenerChange describes a listener replaced due to an address change.
+// Added in v3
+type ListenerChange struct {
+	ID         string `json:"id"`
+	OldNetwork string `json:"oldNetwork"`
+	OldAddr    string `json:"oldAddr"`
+	Network    string `json:"network"`
+	Addr       string `json:"addr"`
+}
+
+// Event is streamed in response to a QueryEvents query.
+// Added in v3
+type Event struct {
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	Peer     Process         `json:"peer"`
+	Error    string          `json:"error,omitempty"`
+	Listener *ListenerChange `json:"listener,omitempty"`
+}
@@ -0,0 +1,105 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenOverlap is like Listen, but instead of serving an inherited listener
+// it binds a fresh SO_REUSEPORT socket alongside it, so the previous owner and
+// this process accept concurrently until Ready. The inherited socket must
+// have SO_REUSEPORT set, which is the case if the previous owner created it
+// with ListenOverlap, and the fresh socket is bound to the inherited socket's
+// address rather than addr.
+//
+// This process' copy of the inherited socket is closed at Ready. Once
+// UpgradeComplete is closed, the previous owner should call HandOffBacklog
+// for the listener instead of closing it, which hands the connections still
+// queued on its socket to the listener returned here.
+func (f *Fds) ListenOverlap(ctx context.Context, id string, network, addr string) (net.Listener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
+	if _, ok := f.backlogSinks[id]; ok {
+		return nil, fmt.Errorf("already listening for %v", id)
+	}
+	if f.locked {
+		return nil, f.lockedReason
+	}
+
+	bindAddr := addr
+	inherited, ok := f.fds[id]
+	if ok {
+		if inherited.Kind != fdKindListener {
+			return nil, fmt.Errorf("fd %v is a %v, not a listener", id, inherited.Kind)
+		}
+		reusePort, err := unix.GetsockoptInt(int(inherited.file.fd), unix.SOL_SOCKET, unix.SO_REUSEPORT)
+		if err != nil {
+			return nil, fmt.Errorf("can't check SO_REUSEPORT on inherited listener: %w", err)
+		}
+		if reusePort == 0 {
+			return nil, fmt.Errorf("inherited listener %v doesn't have SO_REUSEPORT set", id)
+		}
+		sa, err := unix.Getsockname(int(inherited.file.fd))
+		if err != nil {
+			return nil, fmt.Errorf("can't get inherited listener address: %w", err)
+		}
+		if family := sockaddrFamily(sa); family != unix.AF_INET && family != unix.AF_INET6 {
+			return nil, fmt.Errorf("inherited listener %v is not an inet socket", id)
+		}
+		bindAddr = sockaddrString(sa)
+	}
+
+	cfg := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			return errors.Join(err, sockErr)
+		},
+	}
+	ln, err := cfg.Listen(ctx, network, bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("can't create new listener: %w", err)
+	}
+	fdLn, ok := unwrapListener(ln)
+	if !ok {
+		_ = ln.Close()
+		return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
+	}
+	// the previous owner's own handoff may have left the group routing every
+	// connection to the socket which joined it at index 1, which may be this
+	// one
+	raw, err := fdLn.SyscallConn()
+	if err == nil {
+		err = raw.Control(func(fd uintptr) {
+			if err := unsteerReusePortGroup(int(fd)); err != nil {
+				f.l.Warn("can't reset routing of connections to the listener's group", "id", id, "err", err)
+			}
+		})
+	}
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	if inherited != nil {
+		f.l.Info("overlapping inherited listener", "id", id, "addr", bindAddr)
+		delete(f.fds, id)
+		f.retired = append(f.retired, inherited)
+	}
+	if err := f.addListenerLocked(id, network, addr, fdLn); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return f.addBacklogSinkLocked(id, ln), nil
+}
@@ -0,0 +1,179 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestListenOverlap(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	ln1, err := upg1.Fds.ListenOverlap(ctx, "ln", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	ln2, err := upg2.Fds.ListenOverlap(ctx, "ln", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln2.Close() }()
+	require.Equal(t, ln1.Addr().String(), ln2.Addr().String())
+
+	// Neither process accepts yet, so connections queue up on both sockets.
+	const numConns = 20
+	for i := range numConns {
+		conn, err := net.Dial("tcp", ln1.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Write([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	require.NoError(t, upg1.HandOffBacklog("ln", ln1))
+
+	// every connection reaches the new owner
+	var got []int
+	for range numConns {
+		conn, err := ln2.Accept()
+		require.NoError(t, err)
+		b := make([]byte, 1)
+		_, err = conn.Read(b)
+		require.NoError(t, err)
+		got = append(got, int(b[0]))
+		_ = conn.Close()
+	}
+	sort.Ints(got)
+	for i := range numConns {
+		require.Equal(t, i, got[i])
+	}
+}
+
+func TestListenOverlapDialDuringHandOff(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	ln1, err := upg1.Fds.ListenOverlap(ctx, "ln", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+	addr := ln1.Addr().String()
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	ln2, err := upg2.Fds.ListenOverlap(ctx, "ln", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln2.Close() }()
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+
+	// the new owner echoes a byte on every connection
+	go func() {
+		for {
+			conn, err := ln2.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				b := make([]byte, 1)
+				if _, err := conn.Read(b); err == nil {
+					_, _ = conn.Write(b)
+				}
+			}()
+		}
+	}()
+
+	// keep dialing while the previous owner hands off its backlog; none of
+	// the connections may be reset
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := func() error {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						return err
+					}
+					defer func() { _ = conn.Close() }()
+					if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+						return err
+					}
+					if _, err := conn.Write([]byte{1}); err != nil {
+						return err
+					}
+					_, err = conn.Read(make([]byte, 1))
+					return err
+				}()
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, upg1.HandOffBacklog("ln", ln1))
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	default:
+	}
+
+	// once the previous owner exited, its socket left the group
+	upg1.Stop()
+	upg1.Fds.closeAll()
+	for range 10 {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Write([]byte{1})
+		require.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+}
+
+func TestListenOverlapRequiresReusePort(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	ln, err := parent.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	child := newFds(l, parent.copy())
+	_, err = child.ListenOverlap(ctx, "ln", "tcp", "127.0.0.1:0")
+	require.Error(t, err)
+}
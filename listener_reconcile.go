@@ -0,0 +1,86 @@
+package tableroll
+
+// ListenerChange describes an inherited listener which was replaced because
+// its network or address differed from the requested one.
+type ListenerChange struct {
+	ID         string
+	OldNetwork string
+	OldAddr    string
+	Network    string
+	Addr       string
+}
+
+// WithListenerAddressReconciliation makes Fds.Listen and Fds.ListenWith
+// compare the requested network and address with those an inherited listener
+// was created with. On mismatch, a new listener is created for the requested
+// address instead of returning the inherited one, and the inherited one is
+// kept open until Ready, so the previous owner can keep serving it until then,
+// after which it is closed. An EventListenerAddressChanged event describes
+// each replaced listener. Connections the previous owner hands off from the
+// replaced listener with HandOffBacklog are accepted by the new one.
+//
+// Without this option, listeners are looked up by id only, so a listener
+// keeps its address across upgrades even if the requested address changes.
+func WithListenerAddressReconciliation() Option {
+	return func(u *Upgrader) {
+		u.reconcileAddrs = true
+	}
+}
+
+// changedListenerLocked returns the inherited listener with the given id if
+// address reconciliation is enabled and it was created for a different network
+// or address, so that it should be replaced by a listener for the requested
+// one. It is left in the store until the replacement exists.
+func (f *Fds) changedListenerLocked(id, network, addr string) (*fd, error) {
+	if !f.reconcileAddrs {
+		return nil, nil
+	}
+	item, ok := f.fds[id]
+	if !ok || item.Kind != fdKindListener || (item.Network == network && item.Addr == addr) {
+		return nil, nil
+	}
+	if f.locked {
+		return nil, f.lockedReason
+	}
+	return item, nil
+}
+
+// retireListenerLocked retires an inherited listener once a listener for the
+// requested network and address replaced it in the store. The retired
+// listener is no longer passed on to future owners, and is closed at Ready.
+func (f *Fds) retireListenerLocked(item *fd, network, addr string) *ListenerChange {
+	f.l.Info("listener address changed, replaced inherited listener",
+		"id", item.ID, "oldNetwork", item.Network, "oldAddr", item.Addr, "network", network, "addr", addr)
+	f.retired = append(f.retired, item)
+	return &ListenerChange{
+		ID:         item.ID,
+		OldNetwork: item.Network,
+		OldAddr:    item.Addr,
+		Network:    network,
+		Addr:       addr,
+	}
+}
+
+func (f *Fds) notifyListenerChange(change *ListenerChange) {
+	if change != nil && f.onListenerChange != nil {
+		f.onListenerChange(*change)
+	}
+}
+
+// closeRetired closes the listeners replaced due to an address change.
+func (f *Fds) closeRetired() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeRetiredLocked()
+}
+
+func (f *Fds) closeRetiredLocked() {
+	for _, item := range f.retired {
+		f.droppedListeners = append(f.droppedListeners, item.ID)
+		f.l.Info("closing replaced listener", "fd", item)
+		if err := item.file.Close(); err != nil {
+			f.l.Warn("error closing replaced listener", "fd", item, "err", err)
+		}
+	}
+	f.retired = nil
+}
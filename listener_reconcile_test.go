@@ -0,0 +1,122 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestListenerAddressReconciliation(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	oldLn, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	oldAddr := oldLn.Addr().String()
+	require.NoError(t, upg1.Ready())
+
+	var events []Event
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithListenerAddressReconciliation(),
+		WithEventHandler(func(ev Event) { events = append(events, ev) }))
+	require.NoError(t, err)
+	defer upg2.Stop()
+
+	// the same address returns the inherited listener
+	ln, err := upg2.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Equal(t, oldAddr, ln.Addr().String())
+	_ = ln.Close()
+	require.Empty(t, events)
+
+	// a new address replaces it
+	newLn, err := upg2.Fds.Listen(ctx, "ln", nil, "tcp", "localhost:0")
+	require.NoError(t, err)
+	defer func() { _ = newLn.Close() }()
+	require.NotEqual(t, oldAddr, newLn.Addr().String())
+	require.Len(t, events, 1)
+	require.Equal(t, EventListenerAddressChanged, events[0].Type)
+	require.Equal(t, ListenerChange{ID: "ln", OldNetwork: "tcp", OldAddr: "127.0.0.1:0", Network: "tcp", Addr: "localhost:0"}, *events[0].Listener)
+
+	// the old socket stays open until Ready, even once the previous owner
+	// closed its copies
+	_ = oldLn.Close()
+	upg1.Fds.closeAll()
+	conn, err := net.Dial("tcp", oldAddr)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	_, err = net.Dial("tcp", oldAddr)
+	require.Error(t, err)
+	require.Equal(t, EventBecameOwner, events[len(events)-1].Type)
+}
+
+func TestListenerAddressReconciliationDisabled(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	ln, err := parent.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	child := newFds(l, parent.copy())
+	ln, err = child.Listen(ctx, "ln", nil, "tcp", "localhost:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.Equal(t, addr, ln.Addr().String())
+}
+
+func TestListenerAddressReconciliationRebindFails(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	oldLn, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = oldLn.Close() }()
+	oldAddr := oldLn.Addr().String()
+	require.NoError(t, upg1.Ready())
+
+	// something else already listens on the new address
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = taken.Close() }()
+
+	var events []Event
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithListenerAddressReconciliation(),
+		WithEventHandler(func(ev Event) { events = append(events, ev) }))
+	require.NoError(t, err)
+	defer upg2.Stop()
+
+	_, err = upg2.Fds.Listen(ctx, "ln", nil, "tcp", taken.Addr().String())
+	require.Error(t, err)
+	require.Empty(t, events)
+
+	// the inherited listener is still in the store, and survives Ready
+	ln, err := upg2.Fds.Listener("ln")
+	require.NoError(t, err)
+	require.NotNil(t, ln)
+	defer func() { _ = ln.Close() }()
+	require.Equal(t, oldAddr, ln.Addr().String())
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	_ = oldLn.Close()
+	upg1.Fds.closeAll()
+	conn, err := net.Dial("tcp", oldAddr)
+	require.NoError(t, err)
+	_ = conn.Close()
+	for _, ev := range events {
+		require.NotEqual(t, EventListenerAddressChanged, ev.Type)
+	}
+}
@@ -0,0 +1,175 @@
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+)
+
+// MaxConnStateSize bounds the combined size of the Pending and State of all
+// resumable conns handed over in one upgrade. The states are sent along with
+// the file descriptors in a single frame, which the handoff protocol limits to
+// 8 MiB after base64 encoding; half of that leaves room for the encoding and
+// the rest of the store.
+const MaxConnStateSize = proto.MaxFrameSize / 2
+
+// ConnState is transferred along with a resumable connection, so that the
+// next owner can resume serving it mid-stream.
+type ConnState struct {
+	// Pending holds bytes which were already read from the connection but not
+	// yet processed, such as the contents of a bufio.Reader or a partially
+	// read TLS record.
+	Pending []byte `json:"pending,omitempty"`
+	// State is opaque protocol state, such as a websocket's negotiated
+	// extensions or a tunnel's session id.
+	State []byte `json:"state,omitempty"`
+}
+
+// ConnHandoff captures the state of a resumable connection when it is handed
+// over to another process.
+type ConnHandoff interface {
+	// Suspend is called while handing over file descriptors. It must stop this
+	// process from reading from or writing to the connection, and return the
+	// connection's state. If it returns an error, the connection is not handed
+	// over. A state which doesn't fit within MaxConnStateSize is treated the
+	// same way, and Resume is called.
+	Suspend() (ConnState, error)
+	// Resume is called if handing over failed after Suspend was called, in
+	// which case this process remains responsible for the connection.
+	Resume()
+}
+
+// AddResumableConn stores a long-lived connection with the given id, such as
+// one accepted from a listener. When the connection is handed over to another
+// process, the handoff is suspended and its state is transferred with the
+// connection. After a successful upgrade, the connection must no longer be
+// used by this process, and should be closed.
+// The state of all resumable conns together is limited to MaxConnStateSize
+// bytes; conns whose state doesn't fit are resumed and kept by this process
+// instead of failing the upgrade.
+// A next owner running a version of tableroll from before resumable conns
+// were added receives the connection without its state, so Pending and State
+// are lost. Such versions speak v2 of the handoff protocol or older, as do
+// some which keep the state, so the owner logs a warning for a next owner
+// speaking v2 or older that the state may have been lost.
+// The connection may be wrapped, as described on Conn.
+func (f *Fds) AddResumableConn(id, network, addr string, conn net.Conn, handoff ConnHandoff) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked {
+		return f.lockedReason
+	}
+	if _, ok := f.fds[id]; ok {
+		return fmt.Errorf("an fd with id %v already exists", id)
+	}
+	fdConn, ok := unwrapConn(conn)
+	if !ok {
+		return fmt.Errorf("%T doesn't implement tableroll.Conn", conn)
+	}
+	if err := f.addConnLocked(id, fdKindConn, network, addr, fdConn); err != nil {
+		return err
+	}
+	f.fds[id].handoff = handoff
+	return nil
+}
+
+// ResumeConn returns an inherited resumable connection along with the state
+// it was handed over with, or a nil connection if none was inherited.
+// The given handoff, if any, is registered so that the connection can be
+// handed over to the next process in turn.
+func (f *Fds) ResumeConn(id string, handoff ConnHandoff) (net.Conn, *ConnState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, err := f.connLocked(id)
+	if err != nil || conn == nil {
+		return nil, nil, err
+	}
+	item := f.fds[id]
+	state := item.State
+	if state == nil {
+		state = &ConnState{}
+	}
+	item.used = true
+	item.handoff = handoff
+	item.State = nil
+	return conn, state, nil
+}
+
+// suspendForTransfer copies the store for passing it to the next owner.
+// Resumable conns are suspended and their state is captured; a conn which
+// fails to suspend, or whose state would exceed MaxConnStateSize, is not passed
+// on. Conns are suspended in order of their ids, without holding the store's
+// lock, so that handoffs may use the store. The options of listeners are
+// recorded so the next owner can reconcile them.
+func (f *Fds) suspendForTransfer() map[string]*fd {
+	f.mu.Lock()
+	ids := make([]string, 0, len(f.fds))
+	for id := range f.fds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	files := make(map[string]*fd, len(f.fds))
+	var resumable []*fd
+	for _, id := range ids {
+		item := f.fds[id]
+		recordSocketOptions(item)
+		if item.handoff == nil {
+			files[id] = item
+			continue
+		}
+		resumable = append(resumable, item)
+	}
+	f.mu.Unlock()
+
+	stateSize := 0
+	for _, item := range resumable {
+		state, err := item.handoff.Suspend()
+		if err != nil {
+			f.l.Warn("could not suspend resumable conn, not passing it on", "id", item.ID, "err", err)
+			continue
+		}
+		size := len(state.Pending) + len(state.State)
+		if stateSize+size > MaxConnStateSize {
+			f.l.Warn("resumable conn state exceeds MaxConnStateSize, not passing it on", "id", item.ID, "size", size)
+			item.handoff.Resume()
+			continue
+		}
+		stateSize += size
+
+		f.mu.Lock()
+		// the conn may have been removed while it was being suspended
+		if f.fds[item.ID] != item {
+			f.mu.Unlock()
+			continue
+		}
+		item.suspended = true
+		withState := *item
+		withState.State = &state
+		f.mu.Unlock()
+		files[item.ID] = &withState
+	}
+	return files
+}
+
+// resumeConns resumes the conns suspended by suspendForTransfer, after
+// handing them over failed.
+func (f *Fds) resumeConns() {
+	f.mu.Lock()
+	var suspended []ConnHandoff
+	for _, item := range f.fds {
+		if item.suspended {
+			item.suspended = false
+			suspended = append(suspended, item.handoff)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, handoff := range suspended {
+		handoff.Resume()
+	}
+}
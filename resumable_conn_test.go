@@ -0,0 +1,180 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+type fakeHandoff struct {
+	state    ConnState
+	suspends int
+	resumes  int
+}
+
+func (h *fakeHandoff) Suspend() (ConnState, error) {
+	h.suspends++
+	return h.state, nil
+}
+
+func (h *fakeHandoff) Resume() {
+	h.resumes++
+}
+
+func TestResumableConnHandoff(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	serverConn, err := ln.Accept()
+	require.NoError(t, err)
+
+	refuse := true
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")), WithUpgradeFilter(func(context.Context, UpgradeRequest) error {
+		if refuse {
+			return errors.New("not yet")
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+	handoff := &fakeHandoff{state: ConnState{Pending: []byte("GET / HTTP/1.1\r\n"), State: []byte(`{"stream":3}`)}}
+	require.NoError(t, upg1.Fds.AddResumableConn("conn", "tcp", client.LocalAddr().String(), serverConn, handoff))
+	_ = serverConn.Close()
+
+	// a failed handoff resumes the conn
+	_, err = newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.Error(t, err)
+	for {
+		upg1.stateLock.Lock()
+		state := upg1.state
+		upg1.stateLock.Unlock()
+		if state == upgraderStateOwner {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	require.Equal(t, 1, handoff.suspends)
+	require.Equal(t, 1, handoff.resumes)
+
+	refuse = false
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	conn, state, err := upg3.Fds.ResumeConn("conn", nil)
+	require.NoError(t, err)
+	require.Equal(t, handoff.state, *state)
+	require.NoError(t, upg3.Ready())
+	<-upg1.UpgradeComplete()
+	require.Equal(t, 2, handoff.suspends)
+	require.Equal(t, 1, handoff.resumes)
+
+	// the resumed conn is the same connection as before
+	_, err = conn.Write([]byte("resumed"))
+	require.NoError(t, err)
+	_ = conn.Close()
+	data := make([]byte, len("resumed"))
+	_, err = io.ReadFull(client, data)
+	require.NoError(t, err)
+	require.Equal(t, "resumed", string(data))
+}
+
+func TestResumableConnStateLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	fds := newFds(l, nil)
+	defer fds.closeAll()
+	var handoffs []*fakeHandoff
+	for _, id := range []string{"a", "b", "c"} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = client.Close() }()
+		serverConn, err := ln.Accept()
+		require.NoError(t, err)
+		handoff := &fakeHandoff{state: ConnState{Pending: make([]byte, MaxConnStateSize/2)}}
+		handoffs = append(handoffs, handoff)
+		require.NoError(t, fds.AddResumableConn(id, "tcp", client.LocalAddr().String(), serverConn, handoff))
+		_ = serverConn.Close()
+	}
+
+	// the state of "c" doesn't fit, so it's resumed rather than passed on
+	files := fds.suspendForTransfer()
+	require.Contains(t, files, "a")
+	require.Contains(t, files, "b")
+	require.NotContains(t, files, "c")
+	for _, handoff := range handoffs {
+		require.Equal(t, 1, handoff.suspends)
+	}
+	require.Equal(t, 0, handoffs[0].resumes)
+	require.Equal(t, 1, handoffs[2].resumes)
+
+	// the frame carrying the conns fits the protocol's limit
+	fdInfos := make([]*fd, 0, len(files))
+	for _, item := range files {
+		fdInfos = append(fdInfos, item)
+	}
+	require.NoError(t, proto.WriteVersionedJSONBlob(io.Discard, fdInfos, proto.Version))
+}
+
+// storeHandoff uses the store from its callbacks.
+type storeHandoff struct {
+	fds     *Fds
+	suspend string
+	resume  string
+}
+
+func (h *storeHandoff) Suspend() (ConnState, error) {
+	h.suspend = h.fds.String()
+	return ConnState{}, nil
+}
+
+func (h *storeHandoff) Resume() {
+	h.resume = h.fds.String()
+}
+
+func TestResumableConnHandoffUsesStore(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	serverConn, err := ln.Accept()
+	require.NoError(t, err)
+
+	fds := newFds(l, nil)
+	handoff := &storeHandoff{fds: fds}
+	require.NoError(t, fds.AddResumableConn("conn", "tcp", client.LocalAddr().String(), serverConn, handoff))
+	_ = serverConn.Close()
+
+	done := make(chan map[string]*fd)
+	go func() {
+		files := fds.suspendForTransfer()
+		fds.resumeConns()
+		done <- files
+	}()
+	select {
+	case files := <-done:
+		require.Contains(t, files, "conn")
+		fds.closeAll()
+	case <-time.After(5 * time.Second):
+		t.Fatal("handoff callbacks deadlocked on the store")
+	}
+	require.Contains(t, handoff.suspend, "conn")
+	require.Contains(t, handoff.resume, "conn")
+}
@@ -1,6 +1,7 @@
 package tableroll
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
@@ -13,13 +14,22 @@ import (
 
 type sibling struct {
 	conn *net.UnixConn
-	l    *slog.Logger
+	// owner describes this process, which is handing over to the sibling
+	owner  ProcessInfo
+	filter UpgradeFilter
+	// version is the protocol version the sibling sent in its ready handshake
+	version int32
+	// fault is called at fault points, see WithFaultHook
+	fault FaultHook
+	l     *slog.Logger
 }
 
-func newSibling(l *slog.Logger, conn *net.UnixConn) *sibling {
+func newSibling(l *slog.Logger, conn *net.UnixConn, owner ProcessInfo, filter UpgradeFilter) *sibling {
 	return &sibling{
-		conn: conn,
-		l:    l,
+		conn:   conn,
+		owner:  owner,
+		filter: filter,
+		l:      l,
 	}
 }
 
@@ -44,12 +54,16 @@ func (s *sibling) giveFDs(readyTimeoutC <-chan time.Time, passedFiles map[string
 	}
 	defer func() { _ = connFile.Close() }()
 
+	// ctx is cancelled on timeout, and passed along to the upgrade filter
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	functionEnd := make(chan struct{})
 	defer close(functionEnd)
 	go func() {
 		select {
 		case <-functionEnd:
 		case <-readyTimeoutC:
+			cancel()
 			select {
 			case <-functionEnd:
 			default:
@@ -74,6 +88,9 @@ func (s *sibling) giveFDs(readyTimeoutC <-chan time.Time, passedFiles map[string
 	if err := proto.WriteVersionedJSONBlob(s.conn, validFds, proto.Version); err != nil {
 		return fmt.Errorf("error writing json to sibling: %v", err)
 	}
+	if err := s.fault.at(FaultOwnerSentMetadata); err != nil {
+		return err
+	}
 
 	// Write all files it's expecting
 	for _, fi := range validFds {
@@ -81,27 +98,86 @@ func (s *sibling) giveFDs(readyTimeoutC <-chan time.Time, passedFiles map[string
 			return fmt.Errorf("could not write fds to sibling: %v", err)
 		}
 	}
+	// connFile put the connection in blocking mode, in which closing it on
+	// timeout wouldn't interrupt waiting for the sibling to be ready
+	if err := setNonblock(s.conn); err != nil {
+		return errors.Wrap(err, "could not restore non-blocking mode")
+	}
 
-	return s.awaitReady()
+	return s.awaitReady(ctx)
 }
 
-func (s *sibling) awaitReady() error {
-	// Finally, read ready byte and the handoff is done!
+func (s *sibling) awaitReady(ctx context.Context) error {
+	// A v2+ sibling introduces itself before readying up.
 	var b [1]byte
 	n, err := s.conn.Read(b[:])
+	greeted := false
+	if n > 0 && b[0] == proto.V2StartHello {
+		if err := s.hello(ctx); err != nil {
+			return err
+		}
+		greeted = true
+		n, err = s.conn.Read(b[:])
+	}
+
+	// Finally, read ready byte and the handoff is done!
 	switch {
 	case n > 0 && b[0] == proto.V0NotifyReady:
+		// A v0 sibling considers itself the owner as soon as it has written its
+		// ready byte, so there is no safe way to refuse it at this point.
 		s.l.Debug("our sibling sent us a v0 ready")
 		return nil
 	case n > 0 && b[0] == proto.V1StartReadyHandshake:
-		return s.readyHandshake()
+		return s.readyHandshake(ctx, greeted)
 	default:
 		s.l.Debug("our sibling failed to send us a ready", "err", err)
+		if err == nil {
+			// errors.Wrapf would return nil, making us step down
+			err = fmt.Errorf("unexpected byte %#x", b[0])
+		}
 		return errors.Wrapf(err, "sibling did not send us a ready byte: read %v bytes, %v", n, b)
 	}
 }
 
-func (s *sibling) readyHandshake() error {
+// hello reads a sibling's introduction, and accepts or refuses it based on the
+// upgrade filter.
+func (s *sibling) hello(ctx context.Context) error {
+	var hello proto.Hello
+	if err := proto.ReadJSONBlob(s.conn, &hello); err != nil {
+		return errors.Wrap(err, "could not read hello from sibling")
+	}
+	s.l.Info("sibling introduced itself", "id", hello.Process.ID, "appVersion", hello.Process.AppVersion, "labels", hello.Process.Labels)
+	filterErr := s.runFilter(ctx, UpgradeRequest{
+		ProcessInfo:     processInfoFromProto(hello.Process),
+		ProtocolVersion: int(hello.Version),
+	})
+	resp := proto.HelloResponse{
+		Accepted: filterErr == nil,
+		Owner:    s.owner.toProto(),
+	}
+	var rejected *UpgradeRejectedError
+	if errors.As(filterErr, &rejected) {
+		resp.Reason = rejected.Reason
+	}
+	if err := proto.WriteJSONBlob(s.conn, resp); err != nil {
+		return errors.Wrap(err, "could not respond to sibling's hello")
+	}
+	return filterErr
+}
+
+// runFilter runs the upgrade filter, if any, and wraps a refusal in an
+// UpgradeRejectedError.
+func (s *sibling) runFilter(ctx context.Context, req UpgradeRequest) error {
+	if s.filter == nil {
+		return nil
+	}
+	if err := s.filter(ctx, req); err != nil {
+		return &UpgradeRejectedError{Reason: err.Error()}
+	}
+	return nil
+}
+
+func (s *sibling) readyHandshake(ctx context.Context, greeted bool) error {
 	var vInfo proto.VersionInformation
 	err := proto.ReadJSONBlob(s.conn, &vInfo)
 	if err != nil {
@@ -110,10 +186,23 @@ func (s *sibling) readyHandshake() error {
 	// We told our sibling our version via encoding it in the versioned json blob
 	// of files, so it should speak a version we know. If it doesn't, that mean's
 	// it's a misbehaving client.
-	if vInfo.Version != proto.Version {
+	if vInfo.Version < 1 || vInfo.Version > proto.Version {
 		return fmt.Errorf("unable to transfer ownership: unexpected protocol version: %v", vInfo.Version)
 	}
+	s.version = vInfo.Version
+	if !greeted {
+		// A sibling older than v2 couldn't introduce itself, but refusing it is
+		// still safe since it waits for us to step down.
+		if err := s.runFilter(ctx, UpgradeRequest{ProtocolVersion: int(vInfo.Version)}); err != nil {
+			return err
+		}
+	}
 	// Send back that we're stepping down, return nil which causes us to step down.
+	if err := s.fault.at(FaultOwnerSteppingDown); err != nil {
+		s.l.Error("dropping stepping down message", "err", err)
+		_ = s.conn.Close()
+		return nil
+	}
 	err = proto.WriteJSONBlob(s.conn, proto.Message{
 		Msg: proto.V1MessageSteppingDown,
 	})
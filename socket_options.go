@@ -0,0 +1,64 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSocketOptionUnchangeable is set on the SocketOptionDiff of an option
+// which can't be changed on an existing socket nor by rebinding it.
+var ErrSocketOptionUnchangeable = errors.New("option can't be changed on a bound socket")
+
+// SocketOptions are options of a listening socket which are recorded when
+// the socket is handed to a new owner, and which the new owner can reconcile
+// with the options it wants using Fds.ReconcileSocketOptions.
+// Options other than Backlog only apply to TCP sockets.
+type SocketOptions struct {
+	// ReusePort is SO_REUSEPORT. It can't be changed on a bound socket, and a
+	// new socket can only be bound to the same address if both have it set,
+	// so it can't be changed at all.
+	ReusePort bool `json:"reusePort,omitempty"`
+	// FreeBind is IP_FREEBIND. It can't be changed on a bound socket, so
+	// changing it rebinds the socket, which requires ReusePort to be set.
+	FreeBind bool `json:"freeBind,omitempty"`
+	// DeferAccept is TCP_DEFER_ACCEPT in seconds. The kernel rounds it up to
+	// its retransmission schedule.
+	DeferAccept int `json:"deferAccept,omitempty"`
+	// FastOpen is the TCP_FASTOPEN queue length, or 0 if disabled.
+	FastOpen int `json:"fastOpen,omitempty"`
+	// Backlog is the backlog passed to listen(2). The kernel doesn't report it,
+	// so it's 0 unless it was set through Fds.ReconcileSocketOptions, in which
+	// case it's passed on to future owners.
+	Backlog int `json:"backlog,omitempty"`
+}
+
+// SocketOptionDiff describes an option which differed between an inherited
+// socket and the options wanted for it.
+type SocketOptionDiff struct {
+	Option string
+	Have   string
+	Want   string
+	// Err is set if the option could not be changed.
+	Err error
+}
+
+func (d SocketOptionDiff) String() string {
+	if d.Err != nil {
+		return fmt.Sprintf("%v: %v -> %v: %v", d.Option, d.Have, d.Want, d.Err)
+	}
+	return fmt.Sprintf("%v: %v -> %v", d.Option, d.Have, d.Want)
+}
+
+// SocketOptionsReport describes what Fds.ReconcileSocketOptions changed.
+type SocketOptionsReport struct {
+	ID string
+	// Previous are the socket's options before reconciling.
+	Previous SocketOptions
+	// Diffs lists the options which differed, and whether changing them
+	// failed.
+	Diffs []SocketOptionDiff
+	// Rebound is true if the socket was replaced with a new one bound to the
+	// same address, because an option couldn't be changed on the existing
+	// socket.
+	Rebound bool
+}
@@ -0,0 +1,251 @@
+//go:build linux
+
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptions returns the current options of the listener with the given
+// id, or nil if there is no such listener.
+func (f *Fds) SocketOptions(id string) (*SocketOptions, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
+	item, ok := f.fds[id]
+	if !ok || item.file == nil {
+		return nil, nil
+	}
+	if item.Kind != fdKindListener {
+		return nil, fmt.Errorf("fd %v is a %v, not a listener", id, item.Kind)
+	}
+	opts, err := readSocketOptions(item.file.fd, item.SocketOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// ReconcileSocketOptions changes the options of the listener with the given
+// id, inherited or not, to the wanted ones. IP_FREEBIND, which can't be
+// changed on the existing socket, is changed by binding a new socket to the
+// same address, which replaces the existing one in the store, so this should
+// be called before retrieving the listener with Listen or Listener.
+// SO_REUSEPORT can't be changed, which is reported with
+// ErrSocketOptionUnchangeable.
+// A Backlog of 0 leaves the backlog unchanged.
+// While the store is locked for an upgrade, nothing is changed and the reason
+// for the lock is returned, so that the next owner receives the options the
+// socket has.
+//
+// The returned report lists what differed. If some options couldn't be
+// changed, the report is returned along with an error.
+func (f *Fds) ReconcileSocketOptions(id string, want SocketOptions) (*SocketOptionsReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked {
+		return nil, f.lockedReason
+	}
+	if err := f.quarantinedLocked(id); err != nil {
+		return nil, err
+	}
+	item, ok := f.fds[id]
+	if !ok || item.file == nil {
+		return nil, fmt.Errorf("no listener with id %v", id)
+	}
+	if item.Kind != fdKindListener {
+		return nil, fmt.Errorf("fd %v is a %v, not a listener", id, item.Kind)
+	}
+	have, err := readSocketOptions(item.file.fd, item.SocketOptions)
+	if err != nil {
+		return nil, err
+	}
+	report := &SocketOptionsReport{ID: id, Previous: have}
+
+	var errs []error
+	diff := func(option string, have, want any, apply func() error) {
+		d := SocketOptionDiff{Option: option, Have: fmt.Sprint(have), Want: fmt.Sprint(want)}
+		if err := apply(); err != nil {
+			d.Err = err
+			errs = append(errs, fmt.Errorf("can't change %v: %w", option, err))
+		}
+		report.Diffs = append(report.Diffs, d)
+	}
+
+	fd := int(item.file.fd)
+	inet := isInetSocket(fd)
+	if inet && have.ReusePort != want.ReusePort {
+		// a new socket can't be bound alongside the existing one unless both
+		// have SO_REUSEPORT set
+		diff("SO_REUSEPORT", have.ReusePort, want.ReusePort, func() error { return ErrSocketOptionUnchangeable })
+	}
+	if inet && have.FreeBind != want.FreeBind {
+		diff("IP_FREEBIND", have.FreeBind, want.FreeBind, func() error {
+			if !have.ReusePort || !want.ReusePort {
+				return fmt.Errorf("%w without SO_REUSEPORT", ErrSocketOptionUnchangeable)
+			}
+			if err := f.rebindLocked(item, want); err != nil {
+				return err
+			}
+			report.Rebound = true
+			return nil
+		})
+	}
+
+	fd = int(item.file.fd)
+	if inet && have.DeferAccept != deferAcceptSecs(want.DeferAccept) {
+		diff("TCP_DEFER_ACCEPT", have.DeferAccept, want.DeferAccept, func() error {
+			return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, want.DeferAccept)
+		})
+	}
+	if inet && have.FastOpen != want.FastOpen {
+		diff("TCP_FASTOPEN", have.FastOpen, want.FastOpen, func() error {
+			return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, want.FastOpen)
+		})
+	}
+	// A rebound socket has the default backlog, so always apply the wanted one.
+	if want.Backlog != 0 && (have.Backlog != want.Backlog || report.Rebound) {
+		diff("backlog", have.Backlog, want.Backlog, func() error {
+			return unix.Listen(fd, want.Backlog)
+		})
+	}
+
+	current, err := readSocketOptions(item.file.fd, item.SocketOptions)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if want.Backlog != 0 {
+			current.Backlog = want.Backlog
+		}
+		item.SocketOptions = &current
+	}
+	if len(report.Diffs) > 0 {
+		f.l.Info("reconciled socket options", "id", id, "diffs", report.Diffs, "rebound", report.Rebound)
+	}
+	return report, errors.Join(errs...)
+}
+
+// rebindLocked replaces the socket of the given listener with a new one bound
+// to the same address, with the wanted options which can only be set before
+// binding.
+func (f *Fds) rebindLocked(item *fd, want SocketOptions) error {
+	sa, err := unix.Getsockname(int(item.file.fd))
+	if err != nil {
+		return fmt.Errorf("can't get socket address: %w", err)
+	}
+	cfg := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = errors.Join(
+					unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, boolInt(want.ReusePort)),
+					unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_FREEBIND, boolInt(want.FreeBind)),
+				)
+			})
+			return errors.Join(err, sockErr)
+		},
+	}
+	ln, err := cfg.Listen(context.Background(), item.Network, sockaddrString(sa))
+	if err != nil {
+		return fmt.Errorf("can't rebind: %w", err)
+	}
+	defer func() { _ = ln.Close() }()
+	fdLn, ok := unwrapListener(ln)
+	if !ok {
+		return fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
+	}
+	file, err := dupConn(fdLn, item.String())
+	if err != nil {
+		return err
+	}
+	_ = item.file.Close()
+	item.file = file
+	return nil
+}
+
+// recordSocketOptions records the current options of a listener, so that
+// they're passed on to the next owner.
+func recordSocketOptions(item *fd) {
+	if item.Kind != fdKindListener || item.file == nil {
+		return
+	}
+	opts, err := readSocketOptions(item.file.fd, item.SocketOptions)
+	if err != nil {
+		return
+	}
+	item.SocketOptions = &opts
+}
+
+// readSocketOptions reads the options of a socket. The backlog can't be read,
+// so it's taken from the recorded options, if any.
+func readSocketOptions(fd uintptr, recorded *SocketOptions) (SocketOptions, error) {
+	var opts SocketOptions
+	if recorded != nil {
+		opts.Backlog = recorded.Backlog
+	}
+	if !isInetSocket(int(fd)) {
+		return opts, nil
+	}
+	var errs []error
+	getBool := func(level, opt int) bool {
+		v, err := unix.GetsockoptInt(int(fd), level, opt)
+		errs = append(errs, err)
+		return v != 0
+	}
+	getInt := func(level, opt int) int {
+		v, err := unix.GetsockoptInt(int(fd), level, opt)
+		errs = append(errs, err)
+		return v
+	}
+	opts.ReusePort = getBool(unix.SOL_SOCKET, unix.SO_REUSEPORT)
+	opts.FreeBind = getBool(unix.IPPROTO_IP, unix.IP_FREEBIND)
+	opts.DeferAccept = getInt(unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT)
+	opts.FastOpen = getInt(unix.IPPROTO_TCP, unix.TCP_FASTOPEN)
+	if err := errors.Join(errs...); err != nil {
+		return opts, fmt.Errorf("can't read socket options: %w", err)
+	}
+	return opts, nil
+}
+
+func isInetSocket(fd int) bool {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return false
+	}
+	family := sockaddrFamily(sa)
+	return family == unix.AF_INET || family == unix.AF_INET6
+}
+
+// deferAcceptSecs returns the number of seconds the kernel reports for a
+// TCP_DEFER_ACCEPT of the given number of seconds, which it rounds up to a
+// number of SYN-ACK retransmissions.
+func deferAcceptSecs(secs int) int {
+	if secs <= 0 {
+		return 0
+	}
+	const rtoMax = 120
+	timeout, period, retrans := 1, 1, 1
+	for secs > period && retrans < 255 {
+		retrans++
+		timeout = min(timeout*2, rtoMax)
+		period += timeout
+	}
+	return period
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/utils/clock"
+)
+
+func TestReconcileSocketOptions(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	reusePort := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+		},
+	}
+	ln, err := upg1.Fds.Listen(ctx, "ln", reusePort, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	report, err := upg1.Fds.ReconcileSocketOptions("ln", SocketOptions{ReusePort: true, DeferAccept: 5, Backlog: 64})
+	require.NoError(t, err)
+	require.False(t, report.Rebound)
+	require.Len(t, report.Diffs, 2)
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+
+	// the options were passed on
+	opts, err := upg2.Fds.SocketOptions("ln")
+	require.NoError(t, err)
+	require.Equal(t, SocketOptions{ReusePort: true, DeferAccept: deferAcceptSecs(5), Backlog: 64}, *opts)
+
+	// unchanged options aren't reported
+	report, err = upg2.Fds.ReconcileSocketOptions("ln", *opts)
+	require.NoError(t, err)
+	require.Empty(t, report.Diffs)
+
+	// options which can't be changed in place rebind the socket
+	report, err = upg2.Fds.ReconcileSocketOptions("ln", SocketOptions{ReusePort: true, FreeBind: true, FastOpen: 8})
+	require.NoError(t, err)
+	require.True(t, report.Rebound)
+	opts, err = upg2.Fds.SocketOptions("ln")
+	require.NoError(t, err)
+	require.Equal(t, SocketOptions{ReusePort: true, FreeBind: true, FastOpen: 8, Backlog: 64}, *opts)
+
+	ln2, err := upg2.Fds.Listener("ln")
+	require.NoError(t, err)
+	defer func() { _ = ln2.Close() }()
+	require.Equal(t, ln.Addr().String(), ln2.Addr().String())
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+	// the previous owner's store is locked
+	_, err = upg1.Fds.ReconcileSocketOptions("ln", SocketOptions{ReusePort: true, DeferAccept: 10})
+	require.True(t, errors.Is(err, ErrUpgradeCompleted), "expected the store to be locked, got %v", err)
+	_ = ln.Close()
+
+	go func() {
+		conn, err := ln2.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln2.Addr().String())
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestReconcileSocketOptionsUnchangeable(t *testing.T) {
+	fds := newFds(l, nil)
+	ln, err := fds.Listen(context.Background(), "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	// without SO_REUSEPORT on both the existing socket and a new one, nothing
+	// else can bind its address, so neither option can be changed
+	for _, want := range []SocketOptions{{ReusePort: true}, {FreeBind: true}} {
+		report, err := fds.ReconcileSocketOptions("ln", want)
+		require.Error(t, err)
+		require.False(t, report.Rebound)
+		require.Len(t, report.Diffs, 1)
+		require.True(t, errors.Is(report.Diffs[0].Err, ErrSocketOptionUnchangeable), "unexpected error: %v", report.Diffs[0].Err)
+	}
+	opts, err := fds.SocketOptions("ln")
+	require.NoError(t, err)
+	require.Equal(t, SocketOptions{}, *opts)
+
+	reusePort := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+		},
+	}
+	ln2, err := fds.Listen(context.Background(), "ln2", reusePort, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln2.Close() }()
+	report, err := fds.ReconcileSocketOptions("ln2", SocketOptions{})
+	require.Error(t, err)
+	require.False(t, report.Rebound)
+	require.Len(t, report.Diffs, 1)
+	require.True(t, errors.Is(report.Diffs[0].Err, ErrSocketOptionUnchangeable), "unexpected error: %v", report.Diffs[0].Err)
+}
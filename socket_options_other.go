@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tableroll
+
+import "errors"
+
+var errSocketOptionsUnsupported = errors.New("socket options are only supported on linux")
+
+// SocketOptions is only supported on linux.
+func (f *Fds) SocketOptions(id string) (*SocketOptions, error) {
+	return nil, errSocketOptionsUnsupported
+}
+
+// ReconcileSocketOptions is only supported on linux.
+func (f *Fds) ReconcileSocketOptions(id string, want SocketOptions) (*SocketOptionsReport, error) {
+	return nil, errSocketOptionsUnsupported
+}
+
+func recordSocketOptions(item *fd) {}
@@ -0,0 +1,112 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// EnvCoordinationDir is the environment variable in which Spawn passes the
+// coordination directory to the process it starts, which should pass it on
+// to New.
+const EnvCoordinationDir = "TABLEROLL_COORDINATION_DIR"
+
+// EnvGroup is the environment variable in which Spawn passes the group of an
+// upgrader created with WithGroup to the process it starts, which should pass
+// it on to WithGroup.
+const EnvGroup = "TABLEROLL_GROUP"
+
+// ErrSuccessorExited indicates that the process started by Spawn exited
+// before it took over.
+var ErrSuccessorExited = errors.New("successor exited before completing the upgrade")
+
+// Spawn starts cmd as the next owner and waits for it to take over, for
+// deployments in which nothing else starts the new process. cmd may run any
+// binary, not necessarily this process' executable, and is started with
+// EnvCoordinationDir, and EnvGroup if this upgrader is in a group, set in its
+// environment, in addition to cmd.Env or this process' environment if cmd.Env
+// is nil.
+//
+// Spawn returns nil once the upgrade completed, at which point
+// UpgradeComplete is closed. If the process exits before, Spawn returns an
+// error wrapping ErrSuccessorExited, and this process remains the owner. If
+// an upgrade is rejected or fails first, which Spawn assumes is the one the
+// process attempted, or if ctx is cancelled first, the process is killed and
+// the upgrade's error or the context error is returned.
+// The process keeps running after a successful upgrade and is not waited on
+// by the caller.
+func (u *Upgrader) Spawn(ctx context.Context, cmd *exec.Cmd) error {
+	if state, _ := u.ownsFds(); state != upgraderStateOwner {
+		return fmt.Errorf("cannot spawn successor: process is %v, not the owner", state)
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, EnvCoordinationDir+"="+u.coord.dir)
+	if u.group != "" {
+		cmd.Env = append(cmd.Env, EnvGroup+"="+u.group)
+	}
+
+	events, unsubscribe := u.subscribeEvents()
+	defer unsubscribe()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting successor: %w", err)
+	}
+	pid := cmd.Process.Pid
+	u.l.Info("spawned successor", "path", cmd.Path, "pid", pid)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case <-u.upgradeCompleteC:
+			return u.spawnOutcome(pid)
+		case err := <-exited:
+			// it may have exited right after taking over
+			select {
+			case <-u.upgradeCompleteC:
+				return u.spawnOutcome(pid)
+			default:
+			}
+			if err == nil {
+				err = errors.New("exit status 0")
+			}
+			u.l.Error("successor exited before completing the upgrade", "pid", pid, "err", err)
+			return fmt.Errorf("%w: %w", ErrSuccessorExited, err)
+		case ev := <-events:
+			if ev.Type != EventUpgradeRejected && ev.Type != EventUpgradeFailed {
+				continue
+			}
+			u.l.Warn("successor didn't take over, killing it", "pid", pid, "err", ev.Err)
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("successor didn't take over: %w", ev.Err)
+		case <-ctx.Done():
+			// don't kill a successor which took over meanwhile
+			select {
+			case <-u.upgradeCompleteC:
+				return u.spawnOutcome(pid)
+			default:
+			}
+			u.l.Warn("gave up waiting for successor, killing it", "pid", pid, "err", ctx.Err())
+			_ = cmd.Process.Kill()
+			return ctx.Err()
+		}
+	}
+}
+
+// spawnOutcome reports whether UpgradeComplete was closed due to an upgrade
+// rather than Stop.
+func (u *Upgrader) spawnOutcome(pid int) error {
+	u.stateLock.Lock()
+	successor := u.successor
+	u.stateLock.Unlock()
+	if successor == nil {
+		return ErrUpgraderStopped
+	}
+	u.l.Info("successor took over", "pid", pid, "id", successor.ID)
+	return nil
+}
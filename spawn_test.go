@@ -0,0 +1,92 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func spawnHelperCmd(ctx context.Context, funcName string, addr string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=TestSpawnHelper", "--")
+	cmd.Env = append(os.Environ(),
+		"MAIN_FUNC="+funcName,
+		"__TABLEROLL_TEST_PROCESS=1",
+		"LISTEN_ADDR="+addr,
+	)
+	return cmd
+}
+
+func TestSpawn(t *testing.T) {
+	ctx := t.Context()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg.Stop()
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, upg.Ready())
+
+	require.NoError(t, upg.Spawn(ctx, spawnHelperCmd(ctx, "spawned", "ln")))
+	select {
+	case <-upg.UpgradeComplete():
+	default:
+		t.Fatal("expected upgrade to be complete")
+	}
+}
+
+func TestSpawnExitsEarly(t *testing.T) {
+	ctx := t.Context()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	err = upg.Spawn(ctx, spawnHelperCmd(ctx, "exitEarly", ""))
+	require.True(t, errors.Is(err, ErrSuccessorExited), "unexpected error: %v", err)
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, 3, exitErr.ExitCode())
+
+	// still the owner, and able to spawn another successor
+	_, err = upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg.Spawn(ctx, spawnHelperCmd(ctx, "spawned", "ln")))
+}
+
+func TestSpawnRejected(t *testing.T) {
+	ctx := t.Context()
+	coordDir := tmpDir(t)
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithUpgradeFilter(func(context.Context, UpgradeRequest) error {
+			return errors.New("not now")
+		}))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+
+	// the successor keeps running, so only the rejection ends Spawn
+	cmd := spawnHelperCmd(ctx, "stayAfterFailing", "")
+	err = upg.Spawn(ctx, cmd)
+	var rejected *UpgradeRejectedError
+	require.True(t, errors.As(err, &rejected), "unexpected error: %v", err)
+	require.Equal(t, "not now", rejected.Reason)
+
+	// the successor was killed, and this process remains the owner
+	require.Eventually(t, func() bool {
+		return errors.Is(cmd.Process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+}
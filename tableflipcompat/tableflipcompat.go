@@ -0,0 +1,439 @@
+// Package tableflipcompat exposes the API of github.com/cloudflare/tableflip
+// on top of a tableroll.Upgrader, to migrate services from tableflip one at a
+// time.
+//
+// File descriptors are identified the way tableflip identifies them, for
+// example "listener:tcp:127.0.0.1:8080" for a listener, and stored in the
+// underlying tableroll.Fds under that id.
+//
+// On the first start after migrating, the process is typically started by a
+// tableflip parent calling Upgrade. New detects this and inherits the file
+// descriptors the parent passed, and Ready notifies the parent, so it exits
+// like it would for a tableflip child. From then on, upgrades go through
+// tableroll: Upgrade starts the successor with tableroll.Upgrader.Spawn.
+package tableflipcompat
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+const (
+	// sentinelEnvVar is set by a tableflip parent for its child.
+	sentinelEnvVar = "TABLEFLIP_HAS_PARENT_7DIU3"
+	// notifyReady is written to a tableflip parent once the child is ready.
+	notifyReady = 42
+
+	listenKind = "listener"
+	connKind   = "conn"
+	fdKind     = "fd"
+)
+
+// DefaultUpgradeTimeout is how long Upgrade waits for the new process to take
+// over, as in tableflip.
+const DefaultUpgradeTimeout time.Duration = time.Minute
+
+// Options control the behaviour of the Upgrader.
+type Options struct {
+	// CoordinationDir is the tableroll coordination directory. It has no
+	// tableflip equivalent and is required.
+	CoordinationDir string
+	// ID is the process' tableroll id. Defaults to the pid.
+	ID string
+	// UpgradeTimeout is how long Upgrade waits for the new process to take
+	// over. Defaults to DefaultUpgradeTimeout.
+	UpgradeTimeout time.Duration
+	// PIDFile, if set, is written with the pid of this process once it's
+	// ready.
+	PIDFile string
+	// ListenConfig is used to create listeners which weren't inherited.
+	ListenConfig *net.ListenConfig
+	// Logger is passed to tableroll.WithLogger.
+	Logger *slog.Logger
+	// UpgraderOptions are passed to tableroll.New.
+	UpgraderOptions []tableroll.Option
+}
+
+// Upgrader handles zero downtime upgrades with tableflip's API.
+type Upgrader struct {
+	*Fds
+
+	upg            *tableroll.Upgrader
+	parent         *parent
+	upgradeTimeout time.Duration
+	pidFile        string
+}
+
+// New creates an Upgrader, and inherits file descriptors from the previous
+// owner of the coordination directory, or from a tableflip parent.
+func New(opts Options) (*Upgrader, error) {
+	return newUpgrader(opts, osEnv)
+}
+
+func newUpgrader(opts Options, env *env) (*Upgrader, error) {
+	if opts.CoordinationDir == "" {
+		return nil, errors.New("tableflipcompat: a coordination directory is required")
+	}
+	id := opts.ID
+	if id == "" {
+		id = strconv.Itoa(os.Getpid())
+	}
+	timeout := opts.UpgradeTimeout
+	if timeout <= 0 {
+		timeout = DefaultUpgradeTimeout
+	}
+	lc := opts.ListenConfig
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+	upgOpts := append([]tableroll.Option{tableroll.WithUpgradeTimeout(timeout)}, opts.UpgraderOptions...)
+	if opts.Logger != nil {
+		upgOpts = append(upgOpts, tableroll.WithLogger(opts.Logger))
+	}
+
+	p, inherited, err := newParent(env)
+	if err != nil {
+		return nil, err
+	}
+	upg, err := tableroll.New(context.Background(), opts.CoordinationDir, id, upgOpts...)
+	if err != nil {
+		if p != nil {
+			_ = p.wr.Close()
+			closeFiles(inherited)
+		}
+		return nil, err
+	}
+	return &Upgrader{
+		Fds: &Fds{
+			fds:       upg.Fds,
+			lc:        lc,
+			inherited: inherited,
+		},
+		upg:            upg,
+		parent:         p,
+		upgradeTimeout: timeout,
+		pidFile:        opts.PIDFile,
+	}, nil
+}
+
+// Tableroll returns the underlying tableroll.Upgrader, for code which was
+// already migrated to tableroll's API.
+func (u *Upgrader) Tableroll() *tableroll.Upgrader {
+	return u.upg
+}
+
+// Ready signals that the current process is ready to accept connections.
+// It must be called to finish the upgrade. A tableflip parent is notified
+// after tableroll's own handshake, and inherited file descriptors which
+// weren't used are closed.
+func (u *Upgrader) Ready() error {
+	if err := u.upg.Ready(); err != nil {
+		return err
+	}
+	if u.parent != nil {
+		u.Fds.mu.Lock()
+		closeFiles(u.Fds.inherited)
+		u.Fds.inherited = nil
+		u.Fds.mu.Unlock()
+		if err := u.parent.sendReady(); err != nil {
+			return fmt.Errorf("can't notify tableflip parent: %w", err)
+		}
+	}
+	if u.pidFile != "" {
+		if err := writePIDFile(u.pidFile); err != nil {
+			return fmt.Errorf("can't write pid file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Exit returns a channel which is closed when the process should exit.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.upg.UpgradeComplete()
+}
+
+// Stop prevents any more upgrades from happening, and closes the exit
+// channel.
+func (u *Upgrader) Stop() {
+	u.upg.Stop()
+}
+
+// HasParent returns true if a tableflip parent or a previous tableroll owner
+// handed its file descriptors to this process. Previous owners using a
+// tableroll version which doesn't introduce itself are not detected.
+func (u *Upgrader) HasParent() bool {
+	return u.parent != nil || u.upg.PreviousOwner() != nil
+}
+
+// WaitForParent blocks until a tableflip parent has exited, or returns nil
+// right away without one. A previous tableroll owner has already stepped down
+// once Ready returned.
+func (u *Upgrader) WaitForParent(ctx context.Context) error {
+	if u.parent == nil {
+		return nil
+	}
+	select {
+	case err := <-u.parent.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Upgrade starts a new copy of this process' executable with the same
+// arguments, and waits for it to take over, see tableroll.Upgrader.Spawn.
+func (u *Upgrader) Upgrade() error {
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can't find executable: %w", err)
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	ctx, cancel := context.WithTimeout(context.Background(), u.upgradeTimeout)
+	defer cancel()
+	return u.upg.Spawn(ctx, cmd)
+}
+
+func writePIDFile(path string) error {
+	dir, file := filepath.Split(path)
+	fh, err := os.CreateTemp(dir, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err := fh.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// Fds holds all file descriptors inherited from the previous process, with
+// tableflip's API.
+type Fds struct {
+	fds *tableroll.Fds
+	lc  *net.ListenConfig
+
+	mu sync.Mutex
+	// inherited are the files passed by a tableflip parent which haven't been
+	// added to fds yet, by id.
+	inherited map[string]*os.File
+}
+
+func fileID(kind, network, addr string) string {
+	return strings.Join([]string{kind, network, addr}, ":")
+}
+
+// takeInherited returns the file a tableflip parent passed with the given id,
+// which the caller must close.
+func (f *Fds) takeInherited(id string) *os.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, ok := f.inherited[id]
+	if !ok {
+		return nil
+	}
+	delete(f.inherited, id)
+	return file
+}
+
+// Listen returns a listener inherited from the parent process, or creates a
+// new one.
+func (f *Fds) Listen(network, addr string) (net.Listener, error) {
+	return f.ListenWithCallback(network, addr, func(network, addr string) (net.Listener, error) {
+		return f.lc.Listen(context.Background(), network, addr)
+	})
+}
+
+// ListenWithCallback returns a listener inherited from the parent process, or
+// creates a new one using the given callback.
+func (f *Fds) ListenWithCallback(network, addr string, callback func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	id := fileID(listenKind, network, addr)
+	return f.fds.ListenWith(id, network, addr, func(network, addr string) (net.Listener, error) {
+		if file := f.takeInherited(id); file != nil {
+			defer file.Close()
+			return net.FileListener(file)
+		}
+		return callback(network, addr)
+	})
+}
+
+// Listener returns an inherited listener or nil.
+func (f *Fds) Listener(network, addr string) (net.Listener, error) {
+	id := fileID(listenKind, network, addr)
+	ln, err := f.fds.Listener(id)
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	if file := f.takeInherited(id); file != nil {
+		defer file.Close()
+		return f.fds.ListenWith(id, network, addr, func(string, string) (net.Listener, error) {
+			return net.FileListener(file)
+		})
+	}
+	return nil, nil
+}
+
+// AddListener adds a listener, replacing any listener for the same network
+// and address.
+func (f *Fds) AddListener(network, addr string, ln net.Listener) error {
+	id := fileID(listenKind, network, addr)
+	_ = f.fds.Remove(id)
+	if file := f.takeInherited(id); file != nil {
+		_ = file.Close()
+	}
+	_, err := f.fds.ListenWith(id, network, addr, func(string, string) (net.Listener, error) {
+		return ln, nil
+	})
+	return err
+}
+
+// Conn returns an inherited connection or nil.
+func (f *Fds) Conn(network, addr string) (net.Conn, error) {
+	id := fileID(connKind, network, addr)
+	conn, err := f.fds.Conn(id)
+	if conn != nil || err != nil {
+		return conn, err
+	}
+	if file := f.takeInherited(id); file != nil {
+		defer file.Close()
+		return f.fds.DialWith(id, network, addr, func(string, string) (net.Conn, error) {
+			return net.FileConn(file)
+		})
+	}
+	return nil, nil
+}
+
+// AddConn adds a connection, replacing any connection for the same network
+// and address.
+func (f *Fds) AddConn(network, addr string, conn net.Conn) error {
+	id := fileID(connKind, network, addr)
+	_ = f.fds.Remove(id)
+	if file := f.takeInherited(id); file != nil {
+		_ = file.Close()
+	}
+	_, err := f.fds.DialWith(id, network, addr, func(string, string) (net.Conn, error) {
+		return conn, nil
+	})
+	return err
+}
+
+// File returns an inherited file or nil.
+func (f *Fds) File(name string) (*os.File, error) {
+	id := fileID(fdKind, name, "")
+	file, err := f.fds.File(id)
+	if file != nil || err != nil {
+		return file, err
+	}
+	if inherited := f.takeInherited(id); inherited != nil {
+		return f.fds.OpenFileWith(id, name, func(string) (*os.File, error) {
+			return inherited, nil
+		})
+	}
+	return nil, nil
+}
+
+// AddFile adds a file, replacing any file with the same name.
+func (f *Fds) AddFile(name string, file *os.File) error {
+	id := fileID(fdKind, name, "")
+	_ = f.fds.Remove(id)
+	if inherited := f.takeInherited(id); inherited != nil {
+		_ = inherited.Close()
+	}
+	_, err := f.fds.OpenFileWith(id, name, func(string) (*os.File, error) {
+		return file, nil
+	})
+	return err
+}
+
+// env abstracts the process environment a tableflip parent passes files in,
+// for tests.
+type env struct {
+	getenv  func(key string) string
+	newFile func(fd uintptr, name string) *os.File
+}
+
+var osEnv = &env{
+	getenv: os.Getenv,
+	newFile: func(fd uintptr, name string) *os.File {
+		syscall.CloseOnExec(int(fd))
+		return os.NewFile(fd, name)
+	},
+}
+
+// parent is a tableflip process which started this one with its Upgrade.
+type parent struct {
+	wr     *os.File
+	result chan error
+}
+
+// newParent inherits the files passed by a tableflip parent, if there is
+// one. A tableflip parent passes a pipe to notify it of readiness as fd 3, a
+// pipe carrying the gob encoded names of the passed files as fd 4, and the
+// files themselves from fd 5 onwards.
+func newParent(env *env) (*parent, map[string]*os.File, error) {
+	if env.getenv(sentinelEnvVar) == "" {
+		return nil, nil, nil
+	}
+	wr := env.newFile(3, "write")
+	rd := env.newFile(4, "read")
+
+	var names [][]string
+	if err := gob.NewDecoder(rd).Decode(&names); err != nil {
+		_ = wr.Close()
+		_ = rd.Close()
+		return nil, nil, fmt.Errorf("can't decode names from tableflip parent: %w", err)
+	}
+	files := make(map[string]*os.File, len(names))
+	for i, parts := range names {
+		id := strings.Join(parts, ":")
+		files[id] = env.newFile(uintptr(5+i), id)
+	}
+
+	// the parent closes its end of the names pipe once it exits
+	result := make(chan error, 1)
+	go func() {
+		defer rd.Close()
+		n, err := io.Copy(io.Discard, rd)
+		if n != 0 {
+			err = errors.New("unexpected data from tableflip parent")
+		} else if err != nil {
+			err = fmt.Errorf("tableflip parent exited with: %w", err)
+		}
+		result <- err
+	}()
+	return &parent{wr: wr, result: result}, files, nil
+}
+
+func (p *parent) sendReady() error {
+	defer p.wr.Close()
+	_, err := p.wr.Write([]byte{notifyReady})
+	return err
+}
+
+// closeFiles closes the files passed by a tableflip parent which weren't used.
+func closeFiles(files map[string]*os.File) {
+	for _, file := range files {
+		_ = file.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package tableflipcompat
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeParent simulates a tableflip parent which passed a listener.
+type fakeParent struct {
+	env     *env
+	readyR  *os.File
+	namesW  *os.File
+	lnAddr  string
+	parentL net.Listener
+}
+
+func newFakeParent(t *testing.T) *fakeParent {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	lnFile, err := ln.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	readyR, readyW, err := os.Pipe()
+	require.NoError(t, err)
+	namesR, namesW, err := os.Pipe()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = readyR.Close()
+		_ = namesW.Close()
+	})
+	addr := ln.Addr().String()
+	require.NoError(t, gob.NewEncoder(namesW).Encode([][]string{{listenKind, "tcp", addr}}))
+
+	files := map[uintptr]*os.File{3: readyW, 4: namesR, 5: lnFile}
+	return &fakeParent{
+		env: &env{
+			getenv: func(key string) string {
+				if key == sentinelEnvVar {
+					return "yes"
+				}
+				return ""
+			},
+			newFile: func(fd uintptr, _ string) *os.File { return files[fd] },
+		},
+		readyR:  readyR,
+		namesW:  namesW,
+		lnAddr:  addr,
+		parentL: ln,
+	}
+}
+
+func TestInheritFromTableflipParent(t *testing.T) {
+	parent := newFakeParent(t)
+	upg, err := newUpgrader(Options{CoordinationDir: t.TempDir(), ID: "1"}, parent.env)
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.True(t, upg.HasParent())
+
+	ln, err := upg.Listen("tcp", parent.lnAddr)
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.Equal(t, parent.lnAddr, ln.Addr().String())
+	// the parent's listener was closed, so only the inherited one accepts
+	require.NoError(t, parent.parentL.Close())
+	conn, err := net.Dial("tcp", parent.lnAddr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	accepted, err := ln.Accept()
+	require.NoError(t, err)
+	_ = accepted.Close()
+
+	require.NoError(t, upg.Ready())
+	b := make([]byte, 1)
+	_, err = parent.readyR.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, byte(notifyReady), b[0])
+
+	// the parent exits
+	require.NoError(t, parent.namesW.Close())
+	require.NoError(t, upg.WaitForParent(context.Background()))
+
+	// and the listener is handed on with tableroll
+	fds, err := upg.Tableroll().Fds.Listener(fileID(listenKind, "tcp", parent.lnAddr))
+	require.NoError(t, err)
+	require.NotNil(t, fds)
+	_ = fds.Close()
+}
+
+func TestUpgradeBetweenCompatProcesses(t *testing.T) {
+	dir := t.TempDir()
+	upg1, err := newUpgrader(Options{CoordinationDir: dir, ID: "1"}, osEnv)
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.False(t, upg1.HasParent())
+	ln1, err := upg1.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln1.Close() }()
+	f1, err := upg1.File("missing")
+	require.NoError(t, err)
+	require.Nil(t, f1)
+	require.NoError(t, upg1.Ready())
+
+	upg2, err := newUpgrader(Options{CoordinationDir: dir, ID: "2"}, osEnv)
+	require.NoError(t, err)
+	defer upg2.Stop()
+	ln2, err := upg2.Listener("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NotNil(t, ln2)
+	defer func() { _ = ln2.Close() }()
+	require.Equal(t, ln1.Addr().String(), ln2.Addr().String())
+	require.NoError(t, upg2.Ready())
+	<-upg1.Exit()
+	require.True(t, upg2.HasParent())
+	require.NoError(t, upg2.WaitForParent(context.Background()))
+}
@@ -0,0 +1,348 @@
+// Package tabletest simulates chains of tableroll upgrades within a single
+// test process.
+//
+// A Harness starts processes, each with its own tableroll.Upgrader, against a
+// temporary coordination directory and a fake clock. Tests step through
+// handoffs by starting a process, which receives the owner's file descriptors,
+// and calling Ready on it, and can make each stage of a handoff fail, either
+// through the owner's upgrade filter and the new process' health check, or at
+// the protocol's fault points with Process.FailAt and TryStartFailingAt.
+//
+//	h := tabletest.New(t)
+//	p1 := h.Start()
+//	ln, _ := p1.Upgrader.Fds.Listen(ctx, "http", nil, "tcp", "127.0.0.1:0")
+//	p1.Ready()
+//
+//	p1.RejectUpgrades(errors.New("maintenance"))
+//	_, err := h.TryStart() // refused by p1
+//	p1.RejectUpgrades(nil)
+//
+//	p2 := h.Start()
+//	p2.Ready()
+//	h.RequireFds(p2, "http")
+//
+// Processes share the test process, so a crash simulated with Process.Crash
+// doesn't close the file descriptors the crashed process held.
+//
+// The harness asserts with testify's require, so a failing step stops the test
+// with t.FailNow. Like t.FailNow, methods which can fail the test must be
+// called from the goroutine running the test. TryStart and TryReady return
+// errors instead of failing the test, and may be called from other
+// goroutines, such as one driving an upgrade while the test waits on it.
+package tabletest
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+// waitTimeout bounds how long the harness waits, in real time, for processes
+// to react to a step, and waitPoll is how often it checks.
+const (
+	waitTimeout = 10 * time.Second
+	waitPoll    = 10 * time.Millisecond
+)
+
+// Harness runs a chain of processes sharing a coordination directory.
+type Harness struct {
+	// Dir is the coordination directory.
+	Dir string
+	// Clock is the fake clock passed to every upgrader.
+	Clock *clocktesting.FakeClock
+	// UpgradeTimeout is passed to every upgrader with
+	// tableroll.WithUpgradeTimeout.
+	UpgradeTimeout time.Duration
+	// OnStart, if set, is called with each process once it received the
+	// owner's file descriptors, before Start returns it. It can be used to
+	// retrieve the file descriptors which should be passed on along a chain.
+	OnStart func(p *Process)
+	// Group, if set, places every process in the named group of Dir, see
+	// tableroll.WithGroup. Harnesses sharing a Dir with different groups run
+	// independent upgrade chains.
+	Group string
+
+	t      testing.TB
+	opts   []tableroll.Option
+	mu     sync.Mutex
+	nextID int
+	procs  map[string]*Process
+}
+
+// New creates a harness using a temporary coordination directory. The given
+// options are passed to every upgrader it starts. All processes are stopped
+// when the test finishes.
+func New(t testing.TB, opts ...tableroll.Option) *Harness {
+	h := &Harness{
+		Dir:            t.TempDir(),
+		Clock:          clocktesting.NewFakeClock(time.Now()),
+		UpgradeTimeout: tableroll.DefaultUpgradeTimeout,
+		t:              t,
+		opts:           opts,
+		procs:          make(map[string]*Process),
+	}
+	t.Cleanup(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, p := range h.procs {
+			p.Upgrader.Stop()
+		}
+	})
+	return h
+}
+
+// Process is a simulated process in the upgrade chain.
+type Process struct {
+	// ID is the process' tableroll id. Processes are numbered from "1".
+	ID       string
+	Upgrader *tableroll.Upgrader
+
+	h         *Harness
+	mu        sync.Mutex
+	rejectErr error
+	healthErr error
+	faults    map[tableroll.FaultPoint]error
+}
+
+// Start starts a new process, which takes over the file descriptors of the
+// current owner, if any. The test fails if the owner refuses them.
+func (h *Harness) Start(opts ...tableroll.Option) *Process {
+	h.t.Helper()
+	p, err := h.TryStart(opts...)
+	require.NoError(h.t, err)
+	return p
+}
+
+// TryStart is like Start, but returns the error from tableroll.New.
+func (h *Harness) TryStart(opts ...tableroll.Option) (*Process, error) {
+	return h.start(nil, opts)
+}
+
+// TryStartFailingAt is like TryStart, but the new process fails with err at
+// the given fault point, as described for each tableroll.FaultPoint. It
+// reaches the points of tableroll.New, such as tableroll.FaultReceivedFiles,
+// before it is returned; Process.FailAt covers the later ones.
+func (h *Harness) TryStartFailingAt(point tableroll.FaultPoint, err error, opts ...tableroll.Option) (*Process, error) {
+	return h.start(map[tableroll.FaultPoint]error{point: err}, opts)
+}
+
+func (h *Harness) start(faults map[tableroll.FaultPoint]error, opts []tableroll.Option) (*Process, error) {
+	h.mu.Lock()
+	h.nextID++
+	p := &Process{ID: strconv.Itoa(h.nextID), h: h, faults: faults}
+	h.mu.Unlock()
+
+	all := []tableroll.Option{
+		tableroll.WithClock(h.Clock),
+		tableroll.WithUpgradeTimeout(h.UpgradeTimeout),
+		tableroll.WithUpgradeFilter(p.filter),
+		tableroll.WithHealthCheck(tableroll.HealthCheck{Check: p.check}),
+		tableroll.WithGroup(h.Group),
+		tableroll.WithFaultHook(p.fault),
+	}
+	all = append(all, h.opts...)
+	all = append(all, opts...)
+	upg, err := tableroll.New(context.Background(), h.Dir, p.ID, all...)
+	if err != nil {
+		if upg != nil {
+			upg.Stop()
+		}
+		return nil, err
+	}
+	p.Upgrader = upg
+	h.mu.Lock()
+	h.procs[p.ID] = p
+	h.mu.Unlock()
+	if h.OnStart != nil {
+		h.OnStart(p)
+	}
+	return p, nil
+}
+
+// Upgrade starts a new process, makes it ready, and waits for the previous
+// owner, if any, to step down.
+func (h *Harness) Upgrade(opts ...tableroll.Option) *Process {
+	h.t.Helper()
+	prev := h.Owner()
+	p := h.Start(opts...)
+	p.Ready()
+	if prev != nil {
+		prev.RequireSteppedDown()
+	}
+	return p
+}
+
+// Chain performs n upgrades in a row, starting with the current owner if
+// any, and returns the processes started.
+func (h *Harness) Chain(n int, opts ...tableroll.Option) []*Process {
+	h.t.Helper()
+	procs := make([]*Process, 0, n)
+	for range n {
+		procs = append(procs, h.Upgrade(opts...))
+	}
+	return procs
+}
+
+// Process returns the process with the given id, or nil.
+func (h *Harness) Process(id string) *Process {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.procs[id]
+}
+
+// Owner returns the process which owns the coordination directory and is
+// listening for upgrades, or nil if there's none, such as after the owner
+// crashed.
+func (h *Harness) Owner() *Process {
+	h.t.Helper()
+	status, err := tableroll.InspectDir(context.Background(), h.Dir, tableroll.InGroup(h.Group))
+	require.NoError(h.t, err)
+	if !status.OwnerListening {
+		return nil
+	}
+	return h.Process(status.OwnerID)
+}
+
+// RequireOwner fails the test unless p is the owner. A nil p requires that
+// there is no owner.
+func (h *Harness) RequireOwner(p *Process) {
+	h.t.Helper()
+	owner := h.Owner()
+	if p == nil {
+		require.Nil(h.t, owner, "expected no owner")
+		return
+	}
+	require.NotNil(h.t, owner, "expected %v to be the owner, but there is none", p.ID)
+	require.Equal(h.t, p.ID, owner.ID, "unexpected owner")
+}
+
+// RequireFds fails the test unless p is the owner and holds exactly the file
+// descriptors with the given ids.
+func (h *Harness) RequireFds(p *Process, ids ...string) {
+	h.t.Helper()
+	h.RequireOwner(p)
+	fds, err := tableroll.QueryFds(context.Background(), h.Dir, tableroll.InGroup(h.Group))
+	require.NoError(h.t, err)
+	have := make([]string, 0, len(fds))
+	for _, fd := range fds {
+		have = append(have, fd.ID)
+	}
+	want := slices.Sorted(slices.Values(ids))
+	slices.Sort(have)
+	require.Equal(h.t, want, have, "unexpected fds held by %v", p.ID)
+}
+
+// ExpireUpgrade advances the clock past the upgrade timeout, which makes an
+// owner abort an upgrade whose new process hasn't become ready, and waits for
+// the owner to have done so.
+func (h *Harness) ExpireUpgrade() {
+	h.t.Helper()
+	h.Clock.Step(h.UpgradeTimeout + time.Second)
+	require.Eventually(h.t, func() bool {
+		status, err := tableroll.QueryStatus(context.Background(), h.Dir, tableroll.InGroup(h.Group))
+		return err == nil && !status.UpgradeInProgress
+	}, waitTimeout, waitPoll, "owner didn't abort the upgrade")
+}
+
+// Ready makes the process ready, taking over from the previous owner. The
+// test fails if Ready returns an error.
+func (p *Process) Ready() {
+	p.h.t.Helper()
+	require.NoError(p.h.t, p.TryReady())
+}
+
+// TryReady is like Ready, but returns the error from tableroll.Upgrader.Ready.
+func (p *Process) TryReady() error {
+	return p.Upgrader.Ready()
+}
+
+// RequireSteppedDown fails the test unless the process handed over its file
+// descriptors to a new owner, or was stopped.
+func (p *Process) RequireSteppedDown() {
+	p.h.t.Helper()
+	select {
+	case <-p.Upgrader.UpgradeComplete():
+	case <-time.After(waitTimeout):
+		p.h.t.Fatalf("process %v didn't step down", p.ID)
+	}
+}
+
+// RejectUpgrades makes the process, while it is the owner, refuse to hand
+// over its file descriptors with the given reason. A nil err accepts upgrades
+// again.
+func (p *Process) RejectUpgrades(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rejectErr = err
+}
+
+// FailHealthCheck makes the process' health check fail with err, so that
+// Ready aborts the upgrade. A nil err lets the check pass again.
+func (p *Process) FailHealthCheck(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthErr = err
+}
+
+// FailAt makes the process fail with err at the given fault point, as
+// described for each tableroll.FaultPoint. A nil err removes the failure.
+func (p *Process) FailAt(point tableroll.FaultPoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.faults == nil {
+		p.faults = make(map[tableroll.FaultPoint]error)
+	}
+	p.faults[point] = err
+}
+
+// Stop stops the process gracefully with tableroll.Upgrader.Stop, without
+// handing over its file descriptors. A process which hasn't become ready yet
+// abandons the upgrade, and the owner remains the owner. An owner stops
+// listening for upgrades and removes its upgrade socket, so the next process
+// starts without an owner.
+func (p *Process) Stop() {
+	p.Upgrader.Stop()
+}
+
+// Crash simulates the process exiting abruptly. Like Stop, it stops serving
+// upgrades, but leaves its upgrade socket behind without a listener, and the
+// coordination directory keeps naming it as the owner if it was, as a killed
+// process would.
+func (p *Process) Crash() {
+	p.h.t.Helper()
+	p.Upgrader.Stop()
+	// Stop removes the upgrade socket, which a killed process leaves behind
+	path := filepath.Join(p.h.Dir, p.h.Group, p.ID+".sock")
+	sock, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: path})
+	require.NoError(p.h.t, err)
+	sock.SetUnlinkOnClose(false)
+	require.NoError(p.h.t, sock.Close())
+}
+
+func (p *Process) filter(context.Context, tableroll.UpgradeRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rejectErr
+}
+
+func (p *Process) check(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.healthErr
+}
+
+func (p *Process) fault(point tableroll.FaultPoint) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.faults[point]
+}
@@ -0,0 +1,160 @@
+package tabletest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ngrok-oss/tableroll/v4"
+)
+
+// keepListener makes each process keep the "http" listener.
+func keepListener(t *testing.T) func(p *Process) {
+	return func(p *Process) {
+		ln, err := p.Upgrader.Fds.Listen(context.Background(), "http", nil, "tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ln.Close() })
+	}
+}
+
+func TestChain(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	procs := h.Chain(3)
+	h.RequireFds(procs[2], "http")
+	for _, p := range procs[:2] {
+		p.RequireSteppedDown()
+	}
+}
+
+func TestRejectedUpgrade(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	p1 := h.Upgrade()
+
+	p1.RejectUpgrades(errors.New("maintenance"))
+	_, err := h.TryStart()
+	var rejected *tableroll.UpgradeRejectedError
+	require.True(t, errors.As(err, &rejected), "unexpected error: %v", err)
+	h.RequireFds(p1, "http")
+
+	p1.RejectUpgrades(nil)
+	p3 := h.Upgrade()
+	h.RequireFds(p3, "http")
+}
+
+func TestFailedHealthCheck(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	p1 := h.Upgrade()
+
+	p2 := h.Start()
+	p2.FailHealthCheck(errors.New("unhealthy"))
+	require.True(t, errors.Is(p2.TryReady(), tableroll.ErrHealthCheckFailed))
+	h.RequireFds(p1, "http")
+}
+
+func TestCrashBeforeReady(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	p1 := h.Upgrade()
+
+	p2 := h.Start()
+	p2.Crash()
+	require.Eventually(t, func() bool {
+		status, err := tableroll.QueryStatus(context.Background(), h.Dir)
+		return err == nil && !status.UpgradeInProgress
+	}, waitTimeout, waitPoll)
+	h.RequireFds(p1, "http")
+	p3 := h.Upgrade()
+	h.RequireFds(p3, "http")
+}
+
+func TestFailAt(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	p1 := h.Upgrade()
+	errFault := errors.New("injected")
+
+	// the owner aborts the upgrade after sending its metadata
+	p1.FailAt(tableroll.FaultOwnerSentMetadata, errFault)
+	_, err := h.TryStart()
+	require.Error(t, err)
+	h.RequireFds(p1, "http")
+	p1.FailAt(tableroll.FaultOwnerSentMetadata, nil)
+
+	// the new process dies once it received the fds
+	_, err = h.TryStartFailingAt(tableroll.FaultReceivedFiles, errFault)
+	require.True(t, errors.Is(err, errFault), "expected the injected error, got %v", err)
+	require.Eventually(t, func() bool {
+		status, err := tableroll.QueryStatus(context.Background(), h.Dir)
+		return err == nil && !status.UpgradeInProgress
+	}, waitTimeout, waitPoll)
+	h.RequireFds(p1, "http")
+
+	// the new process fails to notify the owner
+	p4 := h.Start()
+	p4.FailAt(tableroll.FaultReadyHandshake, errFault)
+	require.True(t, errors.Is(p4.TryReady(), errFault))
+	h.ExpireUpgrade()
+	h.RequireFds(p1, "http")
+
+	p5 := h.Upgrade()
+	h.RequireFds(p5, "http")
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	h := New(t)
+	h.OnStart = keepListener(t)
+	p1 := h.Upgrade()
+
+	p2 := h.Start()
+	h.ExpireUpgrade()
+	h.RequireFds(p1, "http")
+	// the owner gave up on p2
+	require.Error(t, p2.TryReady())
+}
+
+func TestOwnerCrash(t *testing.T) {
+	h := New(t)
+	p1 := h.Upgrade()
+	p1.Crash()
+	h.RequireOwner(nil)
+	// the crashed owner left its socket behind, and is still named the owner
+	status, err := tableroll.InspectDir(context.Background(), h.Dir)
+	require.NoError(t, err)
+	require.Equal(t, &tableroll.DirStatus{
+		OwnerID:      "1",
+		StaleSockets: []string{h.Dir + "/1.sock"},
+	}, status)
+
+	p2 := h.Upgrade()
+	h.RequireOwner(p2)
+	_, err = net.Dial("unix", h.Dir+"/1.sock")
+	require.Error(t, err)
+}
+
+func TestGroupsShareDir(t *testing.T) {
+	a := New(t)
+	a.Group = "a"
+	a.OnStart = keepListener(t)
+	b := New(t)
+	b.Dir = a.Dir
+	b.Group = "b"
+
+	a1 := a.Upgrade()
+	b1 := b.Upgrade()
+	a2 := a.Upgrade()
+	// upgrading group a left group b alone
+	a.RequireFds(a2, "http")
+	b.RequireOwner(b1)
+	a1.RequireSteppedDown()
+	select {
+	case <-b1.Upgrader.UpgradeComplete():
+		t.Fatal("b1 stepped down")
+	default:
+	}
+}
@@ -13,11 +13,18 @@ import (
 )
 
 type upgradeSession struct {
-	closeOnce    sync.Once
-	wr           *net.UnixConn
+	closeOnce sync.Once
+	wr        *net.UnixConn
+	// keepConn is set once wr is used to receive the owner's backlog, after
+	// which closing the session leaves it open.
+	keepConn     bool
 	coordinator  *coordinator
 	ownerVersion uint32
-	l            *slog.Logger
+	// owner is the owner's introduction, for owners speaking v2+
+	owner *ProcessInfo
+	// fault is called at fault points, see WithFaultHook
+	fault FaultHook
+	l     *slog.Logger
 }
 
 func connectToCurrentOwner(ctx context.Context, l *slog.Logger, coord *coordinator) (*upgradeSession, error) {
@@ -28,6 +35,7 @@ func connectToCurrentOwner(ctx context.Context, l *slog.Logger, coord *coordinat
 
 	sess := &upgradeSession{
 		coordinator: coord,
+		fault:       coord.fault,
 		l:           l,
 	}
 
@@ -65,38 +73,12 @@ func (s *upgradeSession) getFiles(ctx context.Context) (map[string]*fd, error) {
 	}
 	defer func() { _ = sockFile.Close() }()
 
-	functionEnd := make(chan struct{})
-	go func() {
-		select {
-		case <-functionEnd:
-		case <-ctx.Done():
-			// double check the function hasn't already returned, if it has then the
-			// session's out of our hands already.
-			select {
-			case <-functionEnd:
-				return
-			default:
-			}
-			// if there was a context error, close the socket to cause any pending reads/writes to fail
-			_ = s.Close()
-		}
-	}()
-	defer close(functionEnd)
-	// orContextErr returns a context error instead of the passed error if there is one.
-	// This is done under the assumption that the 'err' passed in was caused by
-	// the context cancel/timeout/whatever, and the context error is therefore
-	// both more useful for a programmer to check and a more meaningful message.
-	orContextErr := func(err error) error {
-		if ctxErr := ctx.Err(); ctxErr != nil {
-			return errors.Wrap(ctxErr, err.Error())
-		}
-		return err
-	}
+	defer s.closeOnCancel(ctx)()
 
 	fds := []*fd{}
 	version, err := proto.ReadVersionedJSONBlob(s.wr, &fds)
 	if err != nil {
-		return nil, orContextErr(errors.Wrap(err, "can't read fd metadata from owner process"))
+		return nil, orContextErr(ctx, errors.Wrap(err, "can't read fd metadata from owner process"))
 	}
 	s.ownerVersion = version
 
@@ -117,24 +99,119 @@ func (s *upgradeSession) getFiles(ctx context.Context) (map[string]*fd, error) {
 		file, err := recvFile(sockFile)
 		if err != nil {
 			s.l.Error("error receiving a file descriptor", "err", err)
-			return nil, orContextErr(errors.Wrap(err, "error getting file descriptors"))
+			return nil, orContextErr(ctx, errors.Wrap(err, "error getting file descriptors"))
 		}
 		sockFiles = append(sockFiles, file)
 	}
 	if len(sockFiles) != len(fds) {
 		panic(errors.Errorf("got %v sockfiles, but expected %v: %+v; %+v", len(sockFiles), len(fds), sockFiles, fds))
 	}
+	// receiving the fds put the connection in blocking mode, in which closing it
+	// on cancellation wouldn't interrupt waiting for the owner's hello response
+	if err := setNonblock(s.wr); err != nil {
+		for _, file := range sockFiles {
+			_ = file.Close()
+		}
+		return nil, errors.Wrap(err, "could not restore non-blocking mode")
+	}
 	for i := range fds {
 		fd := fds[i]
 		fd.file = sockFiles[i]
+		if err := verifyFd(fd); err != nil {
+			s.l.Warn("quarantining fd which doesn't match its metadata", "fd", fd, "err", err)
+			_ = fd.file.Close()
+			fd.file = nil
+			fd.mismatch = &FdMismatchError{ID: fd.ID, Kind: string(fd.Kind), Reason: err.Error()}
+		}
 		files[fd.ID] = fd
 	}
+	if err := s.fault.at(FaultReceivedFiles); err != nil {
+		for _, fd := range files {
+			if fd.file != nil {
+				_ = fd.file.Close()
+			}
+		}
+		return nil, err
+	}
 	s.l.Info("got fds from old owner", "files", files)
 	return files, nil
 }
 
+// closeOnCancel closes the session if the given context is cancelled before
+// the returned function is called. This causes any pending reads/writes to
+// fail.
+func (s *upgradeSession) closeOnCancel(ctx context.Context) func() {
+	functionEnd := make(chan struct{})
+	go func() {
+		select {
+		case <-functionEnd:
+		case <-ctx.Done():
+			// double check the function hasn't already returned, if it has then the
+			// session's out of our hands already.
+			select {
+			case <-functionEnd:
+				return
+			default:
+			}
+			// if there was a context error, close the socket to cause any pending reads/writes to fail
+			_ = s.Close()
+		}
+	}()
+	return func() { close(functionEnd) }
+}
+
+// orContextErr returns a context error instead of the passed error if there is one.
+// This is done under the assumption that the 'err' passed in was caused by
+// the context cancel/timeout/whatever, and the context error is therefore
+// both more useful for a programmer to check and a more meaningful message.
+func orContextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrap(ctxErr, err.Error())
+	}
+	return err
+}
+
+// hello introduces this process to an owner which speaks v2+ of the protocol,
+// and returns an UpgradeRejectedError if the owner refuses to hand over its
+// file descriptors to us.
+// It must be called after getFiles.
+func (s *upgradeSession) hello(ctx context.Context, info ProcessInfo) error {
+	if !s.hasOwner() || s.ownerVersion < 2 {
+		return nil
+	}
+	defer s.closeOnCancel(ctx)()
+
+	s.l.Info("introducing ourselves to the owner process")
+	if _, err := s.wr.Write([]byte{proto.V2StartHello}); err != nil {
+		return orContextErr(ctx, errors.Wrap(err, "can't send hello to owner process"))
+	}
+	if err := proto.WriteJSONBlob(s.wr, proto.Hello{
+		Version: proto.Version,
+		Process: info.toProto(),
+	}); err != nil {
+		return orContextErr(ctx, errors.Wrap(err, "can't send hello to owner process"))
+	}
+	var resp proto.HelloResponse
+	if err := proto.ReadJSONBlob(s.wr, &resp); err != nil {
+		return orContextErr(ctx, errors.Wrap(err, "can't read hello response from owner process"))
+	}
+	owner := processInfoFromProto(resp.Owner)
+	s.owner = &owner
+	if !resp.Accepted {
+		return &UpgradeRejectedError{Reason: resp.Reason}
+	}
+	return nil
+}
+
 func (s *upgradeSession) readyHandshake() error {
-	defer func() { _ = s.wr.Close() }()
+	defer func() {
+		if !s.keepConn {
+			_ = s.wr.Close()
+		}
+	}()
+	if err := s.fault.at(FaultReadyHandshake); err != nil {
+		return err
+	}
 	if s.ownerVersion == 0 {
 		s.l.Info("performing v0 ready handshake")
 		if _, err := s.wr.Write([]byte{proto.V0NotifyReady}); err != nil {
@@ -160,10 +237,11 @@ func (s *upgradeSession) readyHandshake() error {
 	if _, err := s.wr.Write([]byte{proto.V1StartReadyHandshake}); err != nil {
 		return errors.Wrap(err, "can't notify owner process")
 	}
-	// now write our explicit version information so it knows to perform a v1
-	// handshake
+	// now write our explicit version information so it knows to perform a v1+
+	// handshake. An owner older than us wouldn't understand our version, so
+	// speak theirs.
 	if err := proto.WriteJSONBlob(s.wr, proto.VersionInformation{
-		Version: proto.Version,
+		Version: int32(min(s.ownerVersion, proto.Version)),
 	}); err != nil {
 		return err
 	}
@@ -178,9 +256,20 @@ func (s *upgradeSession) readyHandshake() error {
 		return fmt.Errorf("expected stepping down message, got %v", obj.Msg)
 	}
 	// at this point they acked us, we can become the owner safely.
+	// An owner speaking v3+ keeps the connection open to hand over its backlog.
+	s.keepConn = s.ownerVersion >= 3
 	return nil
 }
 
+// backlogConn returns the connection over which the previous owner hands over
+// its backlog, or nil if it doesn't. It must be called after readyHandshake.
+func (s *upgradeSession) backlogConn() *net.UnixConn {
+	if !s.keepConn {
+		return nil
+	}
+	return s.wr
+}
+
 func (s *upgradeSession) BecomeOwner() error {
 	return s.coordinator.BecomeOwner()
 }
@@ -188,7 +277,7 @@ func (s *upgradeSession) BecomeOwner() error {
 func (s *upgradeSession) Close() error {
 	var err error
 	s.closeOnce.Do(func() {
-		if s.wr != nil {
+		if s.wr != nil && !s.keepConn {
 			_ = s.wr.Close()
 		}
 		err = s.coordinator.Unlock()
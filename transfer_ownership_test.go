@@ -1,14 +1,21 @@
 package tableroll
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"net"
+	"os"
 	"testing"
 
 	"log/slog"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 	"k8s.io/utils/clock"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
 )
 
 func TestGetFilesCtxCancel(t *testing.T) {
@@ -47,3 +54,150 @@ func TestGetFilesCtxCancel(t *testing.T) {
 		t.Fatalf("expected cancelled error, got: %v", err)
 	}
 }
+
+// TestReadyHandshakeOlderOwner verifies that a new process speaks the owner's
+// protocol version during the ready handshake if the owner is older.
+func TestReadyHandshakeOlderOwner(t *testing.T) {
+	conns := socketPair(t)
+	defer func() { _ = conns[1].Close() }()
+
+	sess := &upgradeSession{wr: conns[0], ownerVersion: 1, l: slog.Default()}
+	// the session has no owner if sending a hello to a v1 owner; it must not
+	// send one
+	require.NoError(t, sess.hello(context.Background(), ProcessInfo{ID: "2"}))
+
+	ownerErr := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := conns[1].Read(b[:]); err != nil {
+			ownerErr <- err
+			return
+		}
+		if b[0] != proto.V1StartReadyHandshake {
+			ownerErr <- fmt.Errorf("expected ready handshake, got %x", b[0])
+			return
+		}
+		var vInfo proto.VersionInformation
+		if err := proto.ReadJSONBlob(conns[1], &vInfo); err != nil {
+			ownerErr <- err
+			return
+		}
+		if vInfo.Version != 1 {
+			ownerErr <- fmt.Errorf("expected version 1, got %v", vInfo.Version)
+			return
+		}
+		ownerErr <- proto.WriteJSONBlob(conns[1], proto.Message{Msg: proto.V1MessageSteppingDown})
+	}()
+	require.NoError(t, sess.readyHandshake())
+	require.NoError(t, <-ownerErr)
+}
+
+// socketPair returns a connected pair of unix stream sockets.
+func socketPair(t testing.TB) [2]*net.UnixConn {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		require.NoError(t, err)
+		_ = f.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns
+}
+
+// peerSends returns our end of a connection on which the peer sent data and
+// then shut down its side for writing.
+func peerSends(t *testing.T, data []byte) *net.UnixConn {
+	conns := socketPair(t)
+	t.Cleanup(func() { _ = conns[1].Close() })
+	go func() {
+		_, _ = conns[1].Write(data)
+		_ = conns[1].CloseWrite()
+	}()
+	return conns[0]
+}
+
+// blobs concatenates single bytes and length-prefixed json blobs, as written
+// by the handshake.
+func blobs(f *testing.F, parts ...any) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		switch part := part.(type) {
+		case int:
+			buf.WriteByte(byte(part))
+		case versioned:
+			require.NoError(f, proto.WriteVersionedJSONBlob(&buf, part.obj, part.version))
+		default:
+			require.NoError(f, proto.WriteJSONBlob(&buf, part))
+		}
+	}
+	return buf.Bytes()
+}
+
+type versioned struct {
+	obj     any
+	version uint32
+}
+
+// FuzzOwnerHandshake feeds arbitrary data from a new process to the owner's
+// side of the handshake, which must neither panic nor hang.
+func FuzzOwnerHandshake(f *testing.F) {
+	f.Add([]byte{proto.V0NotifyReady})
+	f.Add(blobs(f, proto.V1StartReadyHandshake, proto.VersionInformation{Version: 1}))
+	f.Add(blobs(f,
+		proto.V2StartHello, proto.Hello{Version: proto.Version, Process: proto.Process{ID: "2"}},
+		proto.V1StartReadyHandshake, proto.VersionInformation{Version: proto.Version}))
+	f.Add(blobs(f, proto.V2StartHello, proto.Hello{Version: proto.Version, Process: proto.Process{ID: "reject"}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		filter := func(_ context.Context, req UpgradeRequest) error {
+			if req.ID == "reject" {
+				return errors.New("rejected")
+			}
+			return nil
+		}
+		s := newSibling(slog.New(slog.DiscardHandler), peerSends(t, data), ProcessInfo{ID: "1"}, filter)
+		defer func() { _ = s.conn.Close() }()
+		err := s.awaitReady(context.Background())
+		if err == nil && (len(data) == 0 || (data[0] != proto.V0NotifyReady && data[0] != proto.V1StartReadyHandshake && data[0] != proto.V2StartHello)) {
+			t.Fatalf("stepped down for a sibling which didn't get ready: %q", data)
+		}
+	})
+}
+
+// FuzzNewProcessHandshake feeds arbitrary data from an owner to the new
+// process' side of the handshake, which must neither panic nor hang.
+func FuzzNewProcessHandshake(f *testing.F) {
+	f.Add(blobs(f, versioned{[]*fd{}, 0}))
+	f.Add(blobs(f, versioned{[]*fd{}, 1}, proto.Message{Msg: proto.V1MessageSteppingDown}))
+	f.Add(blobs(f,
+		versioned{[]*fd{}, proto.Version},
+		proto.HelloResponse{Accepted: true, Owner: proto.Process{ID: "1"}},
+		proto.Message{Msg: proto.V1MessageSteppingDown}))
+	f.Add(blobs(f, versioned{[]*fd{{ID: "ln", Kind: fdKindListener}}, proto.Version}))
+	f.Add(blobs(f, versioned{[]*fd{}, proto.Version}, proto.HelloResponse{Reason: "no"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx := context.Background()
+		s := &upgradeSession{wr: peerSends(t, data), l: slog.New(slog.DiscardHandler)}
+		defer func() { _ = s.wr.Close() }()
+		files, err := s.getFiles(ctx)
+		if err != nil {
+			return
+		}
+		for _, fd := range files {
+			if fd.file != nil {
+				t.Fatalf("received a file which wasn't sent: %v", fd)
+			}
+		}
+		if err := s.hello(ctx, ProcessInfo{ID: "2"}); err != nil {
+			return
+		}
+		if err := s.readyHandshake(); err != nil {
+			return
+		}
+		if s.ownerVersion >= 1 && !bytes.Contains(data, []byte(proto.V1MessageSteppingDown)) {
+			t.Fatalf("became ready without the owner stepping down: %q", data)
+		}
+	})
+}
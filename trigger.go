@@ -0,0 +1,133 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SignalTrigger configures Upgrader.TriggerOnSignal.
+type SignalTrigger struct {
+	// Signals are the signals which trigger an upgrade. Defaults to SIGHUP.
+	Signals []os.Signal
+	// Command returns the command to start as the successor, see Spawn. It is
+	// called for each triggered upgrade.
+	Command func() *exec.Cmd
+	// Path is the binary to start as the successor if Command is nil, with
+	// this process' arguments and its stdout and stderr. Defaults to this
+	// process' executable.
+	Path string
+	// Timeout bounds how long to wait for the successor to take over before
+	// killing it. Defaults to the upgrade timeout.
+	Timeout time.Duration
+}
+
+// TriggerOnSignal starts an upgrade each time one of the trigger's signals is
+// delivered while this process is the owner, by starting the successor with
+// Spawn. Triggers are refused while an upgrade is already in progress,
+// including one started by another process.
+// The outcome of each trigger is logged, and reported with the
+// EventUpgradeTriggered, EventUpgradeTriggerRefused and
+// EventUpgradeTriggerFailed events, in addition to the events of the upgrade
+// itself.
+//
+// Signals are handled until the upgrade completes or the returned function is
+// called.
+func (u *Upgrader) TriggerOnSignal(trigger SignalTrigger) (stop func()) {
+	signals := trigger.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+	timeout := trigger.Timeout
+	if timeout <= 0 {
+		timeout = u.upgradeTimeout
+	}
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, signals...)
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() {
+			signal.Stop(sigC)
+			close(done)
+		})
+	}
+
+	var triggered atomic.Bool
+	go func() {
+		defer stop()
+		for {
+			select {
+			case sig := <-sigC:
+				if err := u.canTrigger(&triggered); err != nil {
+					u.l.Warn("refusing to trigger upgrade", "signal", sig, "reason", err)
+					u.emit(Event{Type: EventUpgradeTriggerRefused, Err: err})
+					continue
+				}
+				u.l.Info("upgrade triggered", "signal", sig)
+				u.emit(Event{Type: EventUpgradeTriggered})
+				go func() {
+					defer triggered.Store(false)
+					u.runTrigger(trigger, timeout)
+				}()
+			case <-u.upgradeCompleteC:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+// canTrigger claims triggered if no upgrade is in progress.
+func (u *Upgrader) canTrigger(triggered *atomic.Bool) error {
+	state, _ := u.ownsFds()
+	switch state {
+	case upgraderStateOwner:
+	case upgraderStateTransferringOwnership:
+		return ErrUpgradeInProgress
+	default:
+		return fmt.Errorf("process is %v, not the owner", state)
+	}
+	if !triggered.CompareAndSwap(false, true) {
+		return ErrUpgradeInProgress
+	}
+	return nil
+}
+
+func (u *Upgrader) runTrigger(trigger SignalTrigger, timeout time.Duration) {
+	var cmd *exec.Cmd
+	if trigger.Command != nil {
+		cmd = trigger.Command()
+	} else {
+		path := trigger.Path
+		if path == "" {
+			var err error
+			if path, err = os.Executable(); err != nil {
+				u.l.Error("can't find executable to start successor", "err", err)
+				u.emit(Event{Type: EventUpgradeTriggerFailed, Err: err})
+				return
+			}
+		}
+		cmd = exec.Command(path, os.Args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := u.Spawn(ctx, cmd); err != nil {
+		u.l.Error("triggered upgrade failed", "err", err)
+		u.emit(Event{Type: EventUpgradeTriggerFailed, Err: err})
+		return
+	}
+	u.l.Info("triggered upgrade completed")
+}
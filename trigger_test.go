@@ -0,0 +1,77 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+func TestTriggerOnSignal(t *testing.T) {
+	ctx := t.Context()
+	coordDir := tmpDir(t)
+
+	events := make(chan Event, 10)
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithEventHandler(func(ev Event) { events <- ev }))
+	require.NoError(t, err)
+	defer upg.Stop()
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, upg.Ready())
+	require.Equal(t, EventBecameOwner, (<-events).Type)
+
+	stop := upg.TriggerOnSignal(SignalTrigger{
+		Signals: []os.Signal{syscall.SIGUSR1},
+		Command: func() *exec.Cmd { return spawnHelperCmd(ctx, "spawned", "ln") },
+	})
+	defer stop()
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+
+	select {
+	case <-upg.UpgradeComplete():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the triggered upgrade")
+	}
+	require.Equal(t, EventUpgradeTriggered, (<-events).Type)
+	require.Equal(t, EventUpgradeRequested, (<-events).Type)
+	require.Equal(t, EventSteppedDown, (<-events).Type)
+}
+
+func TestTriggerOnSignalRefusedDuringUpgrade(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	events := make(chan Event, 10)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithEventHandler(func(ev Event) { events <- ev }))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+	require.Equal(t, EventBecameOwner, (<-events).Type)
+	stop := upg1.TriggerOnSignal(SignalTrigger{
+		Signals: []os.Signal{syscall.SIGUSR2},
+		Command: func() *exec.Cmd { return exec.Command("false") },
+	})
+	defer stop()
+
+	// another process is taking over
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	require.Equal(t, EventUpgradeRequested, (<-events).Type)
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR2))
+	ev := <-events
+	require.Equal(t, EventUpgradeTriggerRefused, ev.Type)
+	require.Equal(t, ErrUpgradeInProgress, ev.Err)
+
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+}
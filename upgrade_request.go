@@ -0,0 +1,92 @@
+package tableroll
+
+import (
+	"context"
+	"maps"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
+)
+
+// ProcessInfo describes a tableroll process taking part in an upgrade.
+type ProcessInfo struct {
+	// ID is the process's tableroll id, as passed to New.
+	ID string
+	// AppVersion is the application version configured with WithAppVersion.
+	AppVersion string
+	// Labels are the labels configured with WithLabels.
+	Labels map[string]string
+}
+
+// UpgradeRequest describes a process which asked the current owner to hand
+// over its file descriptors.
+type UpgradeRequest struct {
+	ProcessInfo
+	// ProtocolVersion is the version of the handoff protocol the requesting
+	// process speaks. Processes speaking versions older than 2 do not
+	// introduce themselves, so their ProcessInfo is empty.
+	ProtocolVersion int
+}
+
+// UpgradeFilter decides whether the current owner should step down in favour
+// of the requesting process. Returning a non-nil error refuses the upgrade,
+// and the error's message is passed to the requesting process as the reason.
+type UpgradeFilter func(ctx context.Context, req UpgradeRequest) error
+
+// UpgradeRejectedError is returned by New when the current owner's
+// UpgradeFilter refused to hand over its file descriptors.
+type UpgradeRejectedError struct {
+	// Reason is the reason given by the current owner.
+	Reason string
+}
+
+func (e *UpgradeRejectedError) Error() string {
+	return "upgrade rejected by current owner: " + e.Reason
+}
+
+// WithUpgradeFilter configures a filter which is consulted before stepping
+// down in favour of a new process. It can be used to refuse downgrades,
+// refuse upgrades during maintenance, or rate-limit restarts.
+// The new process only introduces itself once it has received the owner's
+// file descriptors, so the filter runs after they were sent: a refused process
+// has already received copies of every file descriptor, which New closes
+// before returning an UpgradeRejectedError. The filter is therefore not an
+// access control; access to the coordination directory is.
+// The filter is called with the context of the upgrade request, which is
+// cancelled if the upgrade times out.
+func WithUpgradeFilter(filter UpgradeFilter) Option {
+	return func(u *Upgrader) {
+		u.upgradeFilter = filter
+	}
+}
+
+// WithAppVersion configures the version of the application, which is sent
+// to the current owner when taking over from it.
+func WithAppVersion(version string) Option {
+	return func(u *Upgrader) {
+		u.appVersion = version
+	}
+}
+
+// WithLabels configures arbitrary labels which are sent to the current owner
+// when taking over from it.
+func WithLabels(labels map[string]string) Option {
+	return func(u *Upgrader) {
+		u.labels = maps.Clone(labels)
+	}
+}
+
+func (p ProcessInfo) toProto() proto.Process {
+	return proto.Process{
+		ID:         p.ID,
+		AppVersion: p.AppVersion,
+		Labels:     p.Labels,
+	}
+}
+
+func processInfoFromProto(p proto.Process) ProcessInfo {
+	return ProcessInfo{
+		ID:         p.ID,
+		AppVersion: p.AppVersion,
+		Labels:     p.Labels,
+	}
+}
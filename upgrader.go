@@ -19,9 +19,39 @@ import (
 // this Upgrader will close the sibling's connection and wait for additional connections.
 const DefaultUpgradeTimeout time.Duration = time.Minute
 
+// ErrHealthCheckFailed indicates that the health check configured with
+// WithHealthCheck did not pass before Ready could complete the upgrade. The
+// upgrade is aborted and the previous owner, if any, remains the owner.
+var ErrHealthCheckFailed = errors.New("health check failed")
+
 // Upgrader handles zero downtime upgrades and passing files between processes.
 type Upgrader struct {
 	upgradeTimeout time.Duration
+	healthCheck    *HealthCheck
+	upgradeFilter  UpgradeFilter
+	appVersion     string
+	labels         map[string]string
+	eventHandler   func(Event)
+	reconcileAddrs bool
+	faultHook      FaultHook
+	group          string
+
+	// eventSubscribers receive events for clients watching them, see
+	// WatchEvents, and for Spawn.
+	eventLock        sync.Mutex
+	eventSubscribers map[chan Event]struct{}
+
+	// queryConns are the query connections being handled, which Stop closes.
+	queryLock    sync.Mutex
+	queryConns   map[*net.UnixConn]struct{}
+	queryStopped bool
+
+	// backlogSender hands connections to the next owner once it took over, and
+	// backlogReceiver receives them from the previous owner.
+	backlogLock     sync.Mutex
+	backlogSender   *backlogSender
+	backlogReceiver *net.UnixConn
+	backlogHandler  func(id string, conn net.Conn)
 
 	coord       *coordinator
 	session     *upgradeSession
@@ -30,6 +60,8 @@ type Upgrader struct {
 
 	stateLock sync.Mutex
 	state     upgraderState
+	// successor is the process this upgrader handed its Fds to.
+	successor *ProcessInfo
 
 	// upgradeCompleteC is closed when this upgrader has serviced an upgrade and
 	// is no longer the owner of its Fds.
@@ -69,6 +101,51 @@ func WithLogger(l *slog.Logger) Option {
 	}
 }
 
+// WithClock configures the clock used for the upgrader's timeouts and
+// timestamps. It is meant for tests, such as those using the tabletest
+// package, which advance a fake clock.
+func WithClock(c clock.Clock) Option {
+	return func(u *Upgrader) {
+		u.clock = c
+	}
+}
+
+// HealthCheck describes a check that Ready runs before notifying the previous
+// owner that this process is ready to take over.
+type HealthCheck struct {
+	// Check reports whether this process is healthy. It is called until it
+	// returns nil or the attempts or timeout are exhausted.
+	Check func(ctx context.Context) error
+	// Attempts is the maximum number of times Check is called. Values below 1
+	// mean a single attempt.
+	Attempts int
+	// Interval is how long to wait between attempts.
+	Interval time.Duration
+	// Timeout bounds the time spent on all attempts. If 0, only Attempts
+	// bounds the check.
+	// The previous owner aborts the upgrade if this process isn't ready within
+	// its upgrade timeout (see WithUpgradeTimeout), so a check taking longer
+	// than that fails the upgrade even if it passes.
+	Timeout time.Duration
+}
+
+// WithHealthCheck configures a health check which must pass before Ready
+// performs the handshake with the previous owner.
+// If the check fails, Ready aborts the upgrade: the previous owner keeps sole
+// control of the file descriptors, the upgrader is stopped, and Ready returns
+// an error wrapping ErrHealthCheckFailed. Listeners and connections the caller
+// already retrieved from Fds are not closed by tableroll.
+//
+// The check runs while this process holds the lock on the coordination
+// directory, so other processes can't start an upgrade until it's done.
+// Listening sockets are shared with the previous owner, so a check connecting
+// to one may be served by the previous owner rather than this process.
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(u *Upgrader) {
+		u.healthCheck = &hc
+	}
+}
+
 // New constructs a tableroll upgrader.
 // The first argument is a directory. All processes in an upgrade chain must
 // use the same coordination directory. The provided directory must exist and
@@ -97,7 +174,12 @@ func newUpgrader(ctx context.Context, clock clock.Clock, coordinationDir string,
 	for _, opt := range opts {
 		opt(u)
 	}
-	u.coord = newCoordinator(clock, u.l, coordinationDir, id)
+	if err := validateGroup(u.group); err != nil {
+		return nil, err
+	}
+	u.coord = newCoordinator(u.clock, u.l, coordinationDir, id)
+	u.coord.group = u.group
+	u.coord.fault = u.faultHook
 
 	listener, err := u.coord.Listen(ctx)
 	if err != nil {
@@ -128,9 +210,27 @@ func (u *Upgrader) becomeOwner(ctx context.Context) (bool, error) {
 		return false, err
 	}
 	u.Fds = newFds(u.l, files)
+	u.Fds.reconcileAddrs = u.reconcileAddrs
+	u.Fds.backlogHandler = u.backlogHandler
+	u.Fds.onListenerChange = func(change ListenerChange) {
+		u.emit(Event{Type: EventListenerAddressChanged, Listener: &change})
+	}
+	if err := sess.hello(ctx, u.processInfo()); err != nil {
+		_ = sess.Close()
+		u.Fds.closeAll()
+		return false, err
+	}
 	return sess.hasOwner(), nil
 }
 
+func (u *Upgrader) processInfo() ProcessInfo {
+	return ProcessInfo{
+		ID:         u.coord.id,
+		AppVersion: u.appVersion,
+		Labels:     u.labels,
+	}
+}
+
 func (u *Upgrader) serveUpgrades() {
 	for {
 		conn, err := u.upgradeSock.AcceptUnix()
@@ -142,6 +242,10 @@ func (u *Upgrader) serveUpgrades() {
 			u.l.Error("error awaiting upgrade", "err", err)
 			continue
 		}
+		if isQueryConn(conn) {
+			go u.handleQuery(conn)
+			continue
+		}
 		go u.handleUpgradeRequest(conn)
 	}
 }
@@ -161,7 +265,12 @@ func (u *Upgrader) mustTransitionTo(state upgraderState) {
 }
 
 func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
+	// keepConn is set if the connection is kept to hand off backlogs over it
+	keepConn := false
 	defer func() {
+		if keepConn {
+			return
+		}
 		if err := conn.Close(); err != nil {
 			u.l.Warn("error closing connection", "err", err)
 		}
@@ -178,11 +287,32 @@ func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
 
 	readyTimeout := u.clock.NewTimer(u.upgradeTimeout)
 	defer readyTimeout.Stop()
-	nextOwner := newSibling(u.l, conn)
-	err := nextOwner.giveFDs(readyTimeout.C(), u.Fds.copy())
+	// peer is filled in once the next owner introduces itself
+	var peer ProcessInfo
+	filter := func(ctx context.Context, req UpgradeRequest) error {
+		peer = req.ProcessInfo
+		u.l.Info("next owner introduced itself", "id", peer.ID, "fromVersion", u.appVersion, "toVersion", peer.AppVersion)
+		u.emit(Event{Type: EventUpgradeRequested, Peer: peer})
+		if u.upgradeFilter == nil {
+			return nil
+		}
+		return u.upgradeFilter(ctx, req)
+	}
+	nextOwner := newSibling(u.l, conn, u.processInfo(), filter)
+	nextOwner.fault = u.faultHook
+	passedFiles := u.Fds.suspendForTransfer()
+	err := nextOwner.giveFDs(readyTimeout.C(), passedFiles)
 	if err != nil {
-		u.l.Error("failed to pass file descriptors to next owner", "reason", "error", "err", err)
+		var rejected *UpgradeRejectedError
+		if errors.As(err, &rejected) {
+			u.l.Info("refused to pass file descriptors to next owner", "reason", rejected.Reason)
+			u.emit(Event{Type: EventUpgradeRejected, Peer: peer, Err: err})
+		} else {
+			u.l.Error("failed to pass file descriptors to next owner", "reason", "error", "err", err)
+			u.emit(Event{Type: EventUpgradeFailed, Peer: peer, Err: err})
+		}
 		// remain owner
+		u.Fds.resumeConns()
 		if err := u.transitionTo(upgraderStateOwner); err != nil {
 			// could happen if 'Stop' was called after 'handleUpgradeRequest'
 			// started, and then the request failed.
@@ -197,19 +327,51 @@ func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
 		return
 	}
 
-	u.l.Info("next owner is ready, marking ourselves as up for exit")
+	u.l.Info("next owner is ready, marking ourselves as up for exit", "id", peer.ID, "fromVersion", u.appVersion, "toVersion", peer.AppVersion)
+	if nextOwner.version < 3 {
+		for id, item := range passedFiles {
+			if item.State != nil {
+				u.l.Warn("next owner speaks protocol v2 or older, and may have lost the state of resumable conn", "id", id, "protocolVersion", nextOwner.version)
+			}
+		}
+	}
 	// ignore error, if we were 'Stopped' we can't transition, but we also
 	// don't care.
 	u.Fds.lockMutations(ErrUpgradeCompleted)
-	_ = u.transitionTo(upgraderStateDraining)
+	u.stateLock.Lock()
+	_ = u.state.transitionTo(upgraderStateDraining)
+	u.successor = &peer
+	u.stateLock.Unlock()
+	if nextOwner.version >= 3 {
+		if sender, err := newBacklogSender(u.l, conn); err != nil {
+			u.l.Warn("can't hand off backlogs to next owner", "err", err)
+		} else {
+			keepConn = true
+			u.backlogLock.Lock()
+			u.backlogSender = sender
+			u.backlogLock.Unlock()
+		}
+	}
+	u.emit(Event{Type: EventSteppedDown, Peer: peer})
 	u.closeUpgradeComplete()
 }
 
 // Ready signals that the current process is ready to accept connections.
 // It must be called to finish the upgrade.
 //
-// All fds which were inherited but not used are closed after the call to Ready.
+// All fds which were inherited but not used are closed after the call to Ready,
+// as are listeners replaced due to an address change (see
+// WithListenerAddressReconciliation).
+//
+// If a health check was configured with WithHealthCheck, it is run before any
+// handshake takes place, and a failure aborts the upgrade.
 func (u *Upgrader) Ready() error {
+	if u.healthCheck != nil {
+		if err := u.checkHealth(); err != nil {
+			return err
+		}
+	}
+
 	u.stateLock.Lock()
 	defer u.stateLock.Unlock()
 
@@ -238,15 +400,98 @@ func (u *Upgrader) Ready() error {
 	if err := u.state.transitionTo(upgraderStateOwner); err != nil {
 		return err
 	}
+	var previous ProcessInfo
+	if prev := u.session.owner; prev != nil {
+		previous = *prev
+		u.l.Info("took over from previous owner", "id", previous.ID, "fromVersion", previous.AppVersion, "toVersion", u.appVersion)
+	}
+	u.emit(Event{Type: EventBecameOwner, Peer: previous})
 
 	// Now cleanup all old FDs while holding the lock
 	u.Fds.lockMutations(ErrClosingListeners)
 	defer u.Fds.unlockMutations()
 	_ = u.Fds.closeUnused()
+	u.Fds.closeRetired()
+
+	if conn := u.session.backlogConn(); conn != nil {
+		u.backlogLock.Lock()
+		u.backlogReceiver = conn
+		u.backlogLock.Unlock()
+		go u.receiveBacklog(conn, u.Fds.takeDroppedListeners())
+	}
 
 	return nil
 }
 
+// checkHealth runs the configured health check. It's called with the
+// coordination directory locked by the upgrade session. If it fails, the
+// upgrade is aborted by closing the upgrade session without notifying the
+// owner, which leaves the owner in sole control of the file descriptors.
+func (u *Upgrader) checkHealth() error {
+	u.stateLock.Lock()
+	err := u.state.canTransitionTo(upgraderStateOwner)
+	u.stateLock.Unlock()
+	if err != nil {
+		return errors.Errorf("cannot become ready: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if u.healthCheck.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, u.healthCheck.Timeout)
+		defer cancel()
+	}
+	// A call to 'Stop' while we're checking should interrupt the check.
+	go func() {
+		select {
+		case <-u.upgradeCompleteC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = u.healthCheck.run(ctx, u.clock)
+	if err == nil {
+		return nil
+	}
+	u.l.Error("health check failed, aborting upgrade", "err", err)
+	if err := u.session.Close(); err != nil {
+		u.l.Error("error closing upgrade session", "err", err)
+	}
+	u.Stop()
+	u.Fds.closeAll()
+	return err
+}
+
+func (hc *HealthCheck) run(ctx context.Context, clock clock.Clock) error {
+	attempts := max(hc.Attempts, 1)
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			select {
+			case <-clock.After(hc.Interval):
+			case <-ctx.Done():
+				return fmt.Errorf("%w after %d attempts: %w (last error: %w)", ErrHealthCheckFailed, i, ctx.Err(), err)
+			}
+		}
+		if err = hc.Check(ctx); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w after %d attempts: %w", ErrHealthCheckFailed, attempts, err)
+}
+
+// PreviousOwner returns information about the process this upgrader took over
+// from, as introduced by it during the upgrade.
+// It returns nil if there was no previous owner, or if the previous owner
+// speaks a protocol version which doesn't exchange process information.
+func (u *Upgrader) PreviousOwner() *ProcessInfo {
+	if u.session == nil {
+		return nil
+	}
+	return u.session.owner
+}
+
 // closeUpgradeComplete safely closes the upgradeCompleteC channel exactly once.
 // This is needed because both handleUpgradeRequest and Stop can close the
 // channel, and without synchronization this races.
@@ -271,10 +516,15 @@ func (u *Upgrader) Stop() {
 		_ = u.session.Close()
 	}
 	u.stopOnce.Do(func() {
-		u.Fds.lockMutations(ErrUpgraderStopped)
+		// Fds is nil if New failed before receiving the owner's fds
+		if u.Fds != nil {
+			u.Fds.lockMutations(ErrUpgraderStopped)
+		}
 		// Interrupt any running Upgrade(), and
 		// prevent new upgrade from happening.
 		_ = u.upgradeSock.Close()
+		u.closeBacklog()
+		u.closeQueries()
 		u.closeUpgradeComplete()
 	})
 }
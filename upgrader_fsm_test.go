@@ -0,0 +1,387 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/clock"
+)
+
+var allUpgraderStates = []upgraderState{
+	upgraderStateCheckingOwner,
+	upgraderStateOwner,
+	upgraderStateTransferringOwnership,
+	upgraderStateDraining,
+	upgraderStateStopped,
+}
+
+func TestUpgraderFSMTransitions(t *testing.T) {
+	// every state is reachable from the initial one
+	reached := map[upgraderState]bool{upgraderStateCheckingOwner: true}
+	queue := []upgraderState{upgraderStateCheckingOwner}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, next := range validTransitions[state] {
+			if !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	for _, state := range allUpgraderStates {
+		require.True(t, reached[state], "%v is unreachable", state)
+	}
+
+	for _, from := range allUpgraderStates {
+		state := from
+		// Stop may be called at any time, and panics if it can't transition
+		require.NoError(t, state.canTransitionTo(upgraderStateStopped), "from %v", from)
+		// only a process which checked for an owner or failed to hand over its
+		// fds becomes the owner
+		if state.canTransitionTo(upgraderStateOwner) == nil {
+			require.Contains(t, []upgraderState{upgraderStateCheckingOwner, upgraderStateTransferringOwnership}, from)
+		}
+		// a failed transition leaves the state alone
+		for _, to := range allUpgraderStates {
+			state := from
+			if state.transitionTo(to) != nil {
+				require.Equal(t, from, state)
+			}
+		}
+	}
+	// a process which stepped down never owns fds again
+	for _, to := range allUpgraderStates {
+		if to != upgraderStateStopped && to != upgraderStateDraining {
+			state := upgraderState(upgraderStateDraining)
+			require.Error(t, state.canTransitionTo(to))
+			state = upgraderStateStopped
+			require.Error(t, state.canTransitionTo(to))
+		}
+	}
+}
+
+// fsmAction is something which happens to the processes of an upgrade at a
+// given step of the handoff.
+type fsmAction string
+
+const (
+	fsmStopOwner fsmAction = "stop-owner"
+	fsmStopNew   fsmAction = "stop-new"
+	fsmFail      fsmAction = "fail"
+)
+
+// Steps of an upgrade, in the order they're reached in a successful one. Those
+// other than fsmBeforeNew and fsmAfterReady are fault points, at which a
+// failure can be injected.
+const (
+	fsmBeforeNew  FaultPoint = "before-new"
+	fsmAfterReady FaultPoint = "after-ready"
+)
+
+var fsmSteps = []FaultPoint{
+	fsmBeforeNew,
+	FaultLocked,
+	FaultOwnerSentMetadata,
+	FaultReceivedFiles,
+	FaultReadyHandshake,
+	FaultOwnerSteppingDown,
+	FaultBecomeOwner,
+	fsmAfterReady,
+}
+
+// fsmActions returns the actions which can happen at the given step.
+func fsmActions(step FaultPoint) []fsmAction {
+	actions := []fsmAction{fsmStopOwner}
+	switch step {
+	case FaultReadyHandshake, FaultOwnerSteppingDown, FaultBecomeOwner, fsmAfterReady:
+		// the new process' upgrader exists once New returned
+		actions = append(actions, fsmStopNew)
+	}
+	if step != fsmBeforeNew && step != fsmAfterReady {
+		actions = append(actions, fsmFail)
+	}
+	return actions
+}
+
+// fsmSchedule assigns at most one action to each step.
+type fsmSchedule map[FaultPoint]fsmAction
+
+func (s fsmSchedule) String() string {
+	var parts []string
+	for _, step := range fsmSteps {
+		if action, ok := s[step]; ok {
+			parts = append(parts, fmt.Sprintf("%v@%v", action, step))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
+}
+
+// fsmSchedules enumerates every schedule with up to maxActions actions.
+func fsmSchedules(maxActions int) []fsmSchedule {
+	schedules := []fsmSchedule{{}}
+	var extend func(from int, sched fsmSchedule)
+	extend = func(from int, sched fsmSchedule) {
+		if len(sched) == maxActions {
+			return
+		}
+		for i := from; i < len(fsmSteps); i++ {
+			for _, action := range fsmActions(fsmSteps[i]) {
+				next := make(fsmSchedule, len(sched)+1)
+				for k, v := range sched {
+					next[k] = v
+				}
+				next[fsmSteps[i]] = action
+				schedules = append(schedules, next)
+				extend(i+1, next)
+			}
+		}
+	}
+	extend(0, fsmSchedule{})
+	return schedules
+}
+
+// TestUpgraderFSMInterleavings hands off fds from an owner to a new process
+// under every schedule of stops and failures at each step of the handoff, and
+// checks that:
+//   - there are never two owners,
+//   - the owner's fds can't be mutated while it transfers them,
+//   - every handoff ends, with the owner either stepping down or remaining
+//     the owner,
+//   - a third process can always become the owner afterwards, and inherits the
+//     fds if anyone still owned them.
+func TestUpgraderFSMInterleavings(t *testing.T) {
+	maxActions := 2
+	if testing.Short() {
+		maxActions = 1
+	}
+	for _, sched := range fsmSchedules(maxActions) {
+		t.Run(sched.String(), func(t *testing.T) {
+			(&fsmRun{t: t, sched: sched}).run()
+		})
+	}
+}
+
+// fsmRun is the handoff from owner to next under one schedule.
+type fsmRun struct {
+	t     *testing.T
+	sched fsmSchedule
+	dir   string
+
+	mu    sync.Mutex
+	armed bool
+	owner *Upgrader
+	next  *Upgrader
+	// async tracks stops which block on the process they stop
+	async sync.WaitGroup
+}
+
+func (r *fsmRun) run() {
+	t := r.t
+	ctx := context.Background()
+	r.dir = tmpDir(t)
+	logger := slog.New(slog.DiscardHandler)
+
+	owner, err := newUpgrader(ctx, clock.RealClock{}, r.dir, "1", WithLogger(logger), WithFaultHook(r.hook))
+	require.NoError(t, err)
+	defer owner.Stop()
+	ln, err := owner.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, owner.Ready())
+	r.mu.Lock()
+	r.owner = owner
+	r.armed = true
+	r.mu.Unlock()
+
+	require.NoError(t, r.hook(fsmBeforeNew))
+	var next *Upgrader
+	// hasLn records which processes hold the listener
+	hasLn := map[*Upgrader]bool{owner: true}
+	r.within("New", func() {
+		next, err = newUpgrader(ctx, clock.RealClock{}, r.dir, "2", WithLogger(logger), WithFaultHook(r.hook))
+	})
+	readyErr := err
+	if err == nil {
+		defer next.Stop()
+		if ln, err := next.Fds.Listener("ln"); err == nil && ln != nil {
+			defer func() { _ = ln.Close() }()
+			hasLn[next] = true
+		}
+		r.mu.Lock()
+		r.next = next
+		r.mu.Unlock()
+		r.within("Ready", func() {
+			readyErr = next.Ready()
+		})
+		require.NoError(t, r.hook(fsmAfterReady))
+	}
+	r.mu.Lock()
+	r.armed = false
+	r.mu.Unlock()
+	r.async.Wait()
+
+	// the handoff ended one way or the other
+	procs := []*Upgrader{owner}
+	if next != nil {
+		procs = append(procs, next)
+	}
+	if readyErr == nil && r.sched[FaultOwnerSteppingDown] != fsmFail {
+		r.within("stepping down", func() { <-owner.UpgradeComplete() })
+	}
+	for _, u := range procs {
+		require.Eventually(t, func() bool {
+			state, _ := observeState(u)
+			return state != upgraderStateTransferringOwnership
+		}, 5*time.Second, time.Millisecond, "%v never finished the handoff", u.coord.id)
+	}
+	var owners []*Upgrader
+	for _, u := range procs {
+		if state, _ := observeState(u); state == upgraderStateOwner {
+			owners = append(owners, u)
+		}
+	}
+	require.LessOrEqual(t, len(owners), 1, "more than one owner")
+	if len(owners) == 1 {
+		id, err := os.ReadFile(owners[0].coord.idFile())
+		require.NoError(t, err)
+		require.Equal(t, owners[0].coord.id, string(id), "the owner isn't recorded as such")
+	}
+
+	// processes which stepped down exit
+	for _, u := range procs {
+		select {
+		case <-u.UpgradeComplete():
+			u.Stop()
+		default:
+		}
+	}
+	var third *Upgrader
+	r.within("New for a third process", func() {
+		third, err = newUpgrader(ctx, clock.RealClock{}, r.dir, "3", WithLogger(logger))
+	})
+	require.NoError(t, err)
+	defer third.Stop()
+	inherited, err := third.Fds.Listener("ln")
+	require.NoError(t, err)
+	if inherited != nil {
+		defer func() { _ = inherited.Close() }()
+	}
+	r.within("Ready for a third process", func() {
+		err = third.Ready()
+	})
+	require.NoError(t, err)
+	if len(owners) == 1 {
+		require.NotNil(t, third.PreviousOwner())
+		require.Equal(t, owners[0].coord.id, third.PreviousOwner().ID)
+		if hasLn[owners[0]] {
+			require.NotNil(t, inherited, "the listener was lost")
+		}
+	}
+}
+
+// hook is the fault hook of both processes. It checks the invariants and
+// performs the scheduled action for the given step.
+func (r *fsmRun) hook(step FaultPoint) error {
+	r.mu.Lock()
+	armed, owner, next := r.armed, r.owner, r.next
+	r.mu.Unlock()
+	if !armed {
+		return nil
+	}
+	r.checkInvariants(owner, next)
+
+	switch r.sched[step] {
+	case fsmStopOwner:
+		r.stop(owner)
+	case fsmStopNew:
+		r.stop(next)
+	case fsmFail:
+		return errInjected
+	}
+	return nil
+}
+
+// stop stops u as if concurrently with the step being performed. Since the
+// step may hold u's locks, stop doesn't wait for long for it to complete.
+func (r *fsmRun) stop(u *Upgrader) {
+	if u == nil {
+		return
+	}
+	done := make(chan struct{})
+	r.async.Add(1)
+	go func() {
+		defer r.async.Done()
+		defer close(done)
+		u.Stop()
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func (r *fsmRun) checkInvariants(procs ...*Upgrader) {
+	owners := 0
+	for _, u := range procs {
+		if u == nil {
+			continue
+		}
+		state, ok := observeState(u)
+		if !ok {
+			// in the middle of a transition
+			continue
+		}
+		if state == upgraderStateOwner && !fdsLocked(u.Fds) {
+			owners++
+		}
+		if state == upgraderStateTransferringOwnership {
+			if _, err := u.Fds.Listen(context.Background(), "mutation", nil, "tcp", "127.0.0.1:0"); err == nil {
+				r.t.Errorf("%v's fds were mutated during a transfer", u.coord.id)
+			}
+		}
+	}
+	if owners > 1 {
+		r.t.Errorf("there are %v owners", owners)
+	}
+}
+
+// within fails the test if fn doesn't return in time, rather than hanging.
+func (r *fsmRun) within(what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		r.t.Fatalf("%v hung", what)
+	}
+}
+
+func fdsLocked(f *Fds) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.locked
+}
+
+// observeState returns u's state, unless it is held by a transition in
+// progress.
+func observeState(u *Upgrader) (upgraderState, bool) {
+	if !u.stateLock.TryLock() {
+		return "", false
+	}
+	defer u.stateLock.Unlock()
+	return u.state, true
+}
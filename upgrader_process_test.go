@@ -330,6 +330,12 @@ func TestSpawnHelper(t *testing.T) {
 		os.Exit(main2())
 	case "listenOnManySockets":
 		os.Exit(listenOnManySockets())
+	case "spawned":
+		os.Exit(spawned())
+	case "exitEarly":
+		os.Exit(3)
+	case "stayAfterFailing":
+		os.Exit(stayAfterFailing())
 	default:
 		fmt.Fprintf(os.Stderr, "unknown main function: %v", funcName)
 		os.Exit(1)
@@ -373,6 +379,43 @@ func main1() int {
 	return 0
 }
 
+// spawned takes over the listener at LISTEN_ADDR from the process which
+// started it with Upgrader.Spawn.
+func spawned() int {
+	ctx := context.Background()
+	upg, err := New(ctx, os.Getenv(EnvCoordinationDir), strconv.Itoa(os.Getpid()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v", err)
+		return 1
+	}
+	if _, err := upg.Fds.Listener(os.Getenv("LISTEN_ADDR")); err != nil {
+		fmt.Fprintf(os.Stderr, "%v", err)
+		return 1
+	}
+	if err := upg.Ready(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v", err)
+		return 1
+	}
+	<-upg.UpgradeComplete()
+	return 0
+}
+
+// stayAfterFailing tries to take over from the process which started it with
+// Upgrader.Spawn, and keeps running if that fails.
+func stayAfterFailing() int {
+	ctx := context.Background()
+	upg, err := New(ctx, os.Getenv(EnvCoordinationDir), strconv.Itoa(os.Getpid()))
+	if err == nil {
+		err = upg.Ready()
+	}
+	if err == nil {
+		<-upg.UpgradeComplete()
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%v", err)
+	select {}
+}
+
 // main1, but unix sockets
 func main2() int {
 	ctx := context.Background()
@@ -2,6 +2,7 @@ package tableroll
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
@@ -18,6 +19,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"k8s.io/utils/clock"
 	fakeclock "k8s.io/utils/clock/testing"
+
+	"github.com/ngrok-oss/tableroll/v4/internal/proto"
 )
 
 var l = slog.Default()
@@ -320,6 +323,9 @@ func TestUpgradeTimeout(t *testing.T) {
 	if err := upg2.Ready(); err == nil {
 		t.Fatalf("should not be able to mark as ready after parent timed out")
 	}
+	// upg1 remains the owner
+	_, err = upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
 }
 
 // TestFTestFailedUpgradeAccept tests that 'ln.Accept' works for a listener
@@ -353,6 +359,217 @@ func TestFailedUpgradeListen(t *testing.T) {
 	// if we aren't deadlocked here, the regression test passes
 }
 
+// TestHealthCheckAbortsUpgrade verifies that a failing health check aborts the
+// upgrade and leaves the previous owner in control of its fds.
+func TestHealthCheckAbortsUpgrade(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	_, err = upg1.Fds.Listen(ctx, "id", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, upg1.Ready())
+
+	attempts := 0
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")), WithHealthCheck(HealthCheck{
+		Check: func(context.Context) error {
+			attempts++
+			return errors.New("unhealthy")
+		},
+		Attempts: 3,
+		Interval: time.Millisecond,
+	}))
+	require.NoError(t, err)
+	err = upg2.Ready()
+	require.True(t, errors.Is(err, ErrHealthCheckFailed), "expected health check error, got %v", err)
+	require.Equal(t, 3, attempts)
+	<-upg2.UpgradeComplete()
+
+	// Wait for upg1 to notice the aborted upgrade and remain the owner.
+	for {
+		upg1.stateLock.Lock()
+		state := upg1.state
+		upg1.stateLock.Unlock()
+		if state == upgraderStateOwner {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	select {
+	case <-upg1.UpgradeComplete():
+		t.Fatalf("upg1 should have remained the owner")
+	default:
+	}
+
+	// the previous owner can still pass its fds on to a healthy process
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")), WithHealthCheck(HealthCheck{
+		Check: func(context.Context) error { return nil },
+	}))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	ln, err := upg3.Fds.Listener("id")
+	require.NoError(t, err)
+	require.NotNil(t, ln)
+	_ = ln.Close()
+	require.NoError(t, upg3.Ready())
+	<-upg1.UpgradeComplete()
+}
+
+func TestHealthCheckRetries(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	attempts := 0
+	upg, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l), WithHealthCheck(HealthCheck{
+		Check: func(context.Context) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		},
+		Attempts: 5,
+		Interval: time.Millisecond,
+		Timeout:  5 * time.Second,
+	}))
+	require.NoError(t, err)
+	defer upg.Stop()
+	require.NoError(t, upg.Ready())
+	require.Equal(t, 3, attempts)
+}
+
+// TestUpgradeFilter verifies that an owner can refuse an upgrade based on the
+// new process's introduction, and remains the owner if it does.
+func TestUpgradeFilter(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	requests := make(chan UpgradeRequest, 2)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")), WithAppVersion("1.0.0"), WithUpgradeFilter(func(_ context.Context, req UpgradeRequest) error {
+		requests <- req
+		if req.AppVersion < "1.0.0" {
+			return errors.New("refusing to downgrade")
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.NoError(t, upg1.Ready())
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")), WithAppVersion("0.9.0"))
+	var rejected *UpgradeRejectedError
+	require.True(t, errors.As(err, &rejected), "expected rejection, got %v", err)
+	require.Equal(t, "refusing to downgrade", rejected.Reason)
+	require.Equal(t, UpgradeRequest{
+		ProcessInfo:     ProcessInfo{ID: "2", AppVersion: "0.9.0"},
+		ProtocolVersion: proto.Version,
+	}, <-requests)
+
+	// Wait for upg1 to remain the owner after refusing.
+	for {
+		upg1.stateLock.Lock()
+		state := upg1.state
+		upg1.stateLock.Unlock()
+		if state == upgraderStateOwner {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "3", WithLogger(l.With("pid", "3")), WithAppVersion("1.1.0"), WithLabels(map[string]string{"shard": "a"}))
+	require.NoError(t, err)
+	defer upg3.Stop()
+	require.Equal(t, UpgradeRequest{
+		ProcessInfo:     ProcessInfo{ID: "3", AppVersion: "1.1.0", Labels: map[string]string{"shard": "a"}},
+		ProtocolVersion: proto.Version,
+	}, <-requests)
+	require.NoError(t, upg3.Ready())
+	<-upg1.UpgradeComplete()
+}
+
+// TestUpgradeFilterCtxCancel verifies that cancelling New's context interrupts
+// waiting for a slow upgrade filter.
+func TestUpgradeFilterCtxCancel(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	filtering := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")), WithUpgradeTimeout(time.Minute), WithUpgradeFilter(func(context.Context, UpgradeRequest) error {
+		close(filtering)
+		<-release
+		return nil
+	}))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	// receiving fds is what used to leave the connection in blocking mode
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	require.NoError(t, upg1.Ready())
+
+	ctx2, cancel2 := context.WithCancel(ctx)
+	errC := make(chan error, 1)
+	go func() {
+		upg2, err := newUpgrader(ctx2, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")))
+		if err == nil {
+			upg2.Stop()
+		}
+		errC <- err
+	}()
+	<-filtering
+	cancel2()
+	select {
+	case err := <-errC:
+		require.Error(t, err)
+		require.True(t, errors.Is(err, context.Canceled), "expected a context error, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context didn't interrupt the hello")
+	}
+}
+
+// TestAppVersionExchange verifies that both processes learn about each other
+// during an upgrade.
+func TestAppVersionExchange(t *testing.T) {
+	ctx := context.Background()
+	coordDir := tmpDir(t)
+
+	events1 := make(chan Event, 10)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "1", WithLogger(l.With("pid", "1")),
+		WithAppVersion("1.2.3"),
+		WithLabels(map[string]string{"build": "abc"}),
+		WithEventHandler(func(ev Event) { events1 <- ev }))
+	require.NoError(t, err)
+	defer upg1.Stop()
+	require.Nil(t, upg1.PreviousOwner())
+	require.NoError(t, upg1.Ready())
+	require.Equal(t, EventBecameOwner, (<-events1).Type)
+
+	var events2 []Event
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, coordDir, "2", WithLogger(l.With("pid", "2")),
+		WithAppVersion("1.2.4"),
+		WithEventHandler(func(ev Event) { events2 = append(events2, ev) }))
+	require.NoError(t, err)
+	defer upg2.Stop()
+	owner1 := ProcessInfo{ID: "1", AppVersion: "1.2.3", Labels: map[string]string{"build": "abc"}}
+	require.Equal(t, &owner1, upg2.PreviousOwner())
+	require.NoError(t, upg2.Ready())
+	<-upg1.UpgradeComplete()
+
+	owner2 := ProcessInfo{ID: "2", AppVersion: "1.2.4"}
+	for _, expected := range []EventType{EventUpgradeRequested, EventSteppedDown} {
+		ev := <-events1
+		require.Equal(t, expected, ev.Type)
+		require.Equal(t, owner2, ev.Peer)
+	}
+	require.Len(t, events2, 1)
+	require.Equal(t, EventBecameOwner, events2[0].Type)
+	require.Equal(t, owner1, events2[0].Peer)
+}
+
 func assertResp(t *testing.T, url string, c *http.Client, expected string) {
 	resp, err := c.Get(url)
 	require.NoError(t, err)